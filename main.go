@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/mozey/logutil"
 	"github.com/mozey/watcher/pkg/watcher"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -46,23 +48,47 @@ func main() {
 		sig <- os.Signal(syscall.SIGINT)
 
 	} else if out.Cmd == watcher.CmdWatch {
-		defer (func() {
-			_ = out.Watcher.Close()
-		})()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 		go (func() {
-			select {
-			case err, ok := <-out.Watcher.Errors:
-				if !ok {
-					return
-				}
+			var err error
+			if out.Group != nil {
+				err = out.Group.Run(ctx)
+			} else {
+				err = out.Watcher.Run(ctx)
+			}
+			if errors.Is(err, watcher.ErrTimeout) {
+				log.Info().Msg("Nothing changed before timeout")
+				exitCode = 3
+			} else if err != nil {
 				log.Error().Stack().Err(err).Msg("")
 				exitCode = 2
-				sig <- os.Signal(syscall.SIGINT)
 			}
+			// Run only returns early on error, timeout or once mode
+			sig <- os.Signal(syscall.SIGINT)
 		})()
+
+	} else {
+		// Sub commands are done
+		exitCode = out.ExitCode
+		sig <- os.Signal(syscall.SIGINT)
 	}
 
 	// Wait on exit signal
 	<-sig
+
+	runners := out.Runners
+	if out.Runner != nil {
+		runners = append(runners, out.Runner)
+	}
+	for _, runner := range runners {
+		// Shut down the command before exiting
+		err = runner.Stop()
+		if err != nil {
+			log.Error().Stack().Err(err).Msg("")
+			exitCode = 2
+		}
+	}
+
 	os.Exit(exitCode)
 }
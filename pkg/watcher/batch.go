@@ -0,0 +1,68 @@
+package watcher
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Change to a file or dir during the debounce window
+type Change struct {
+	// Path is the absolute path
+	Path string
+	// Op is the set of operations seen for the path
+	Op fsnotify.Op
+	// Root is the watched dir the path is in
+	Root string
+	// Time of the last event for the path
+	Time time.Time
+
+	seq int
+}
+
+// Batch collects the changes seen during the debounce window,
+// with one change per path
+type Batch struct {
+	mu      sync.Mutex
+	seq     int
+	changes map[string]*Change
+}
+
+// Add the event to the batch, root is the watched dir the path is in
+func (b *Batch) Add(event fsnotify.Event, root string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.changes == nil {
+		b.changes = make(map[string]*Change)
+	}
+	b.seq++
+	change, ok := b.changes[event.Name]
+	if !ok {
+		change = &Change{Path: event.Name, Root: root}
+		b.changes[event.Name] = change
+	}
+	change.Op |= event.Op
+	change.Time = time.Now()
+	change.seq = b.seq
+}
+
+// Flush returns the changes and resets the batch.
+// Changes are ordered by the last event for each path,
+// i.e. the last change is for the most recently modified path
+func (b *Batch) Flush() []Change {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	changes := make([]Change, 0, len(b.changes))
+	for _, change := range b.changes {
+		changes = append(changes, *change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].seq < changes[j].seq
+	})
+	b.changes = nil
+	return changes
+}
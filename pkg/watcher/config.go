@@ -0,0 +1,239 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ConfigFile is loaded from the base dir if the config flag is not set
+const ConfigFile = "watcher.json"
+
+// configFields maps config keys to the CmdIn fields,
+// keys are the json tags on the fields
+func (in *CmdIn) configFields() map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(in).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		fields[key] = v.Field(i)
+	}
+	return fields
+}
+
+// flagsSet returns the config keys for fields set with command line flags.
+// Flags are matched to fields by the pointer the flag value wraps
+func (in *CmdIn) flagsSet(fs *flag.FlagSet) map[string]bool {
+	keys := make(map[string]uintptr)
+	for key, field := range in.configFields() {
+		keys[key] = field.Addr().Pointer()
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		v := reflect.ValueOf(f.Value)
+		if v.Kind() != reflect.Ptr {
+			return
+		}
+		for key, p := range keys {
+			if v.Pointer() == p {
+				set[key] = true
+			}
+		}
+	})
+	return set
+}
+
+// unmarshal the value, durations must be strings, e.g. "500ms".
+// Numbers are rejected, they would be read as nanoseconds
+func unmarshal(b []byte, v interface{}) error {
+	if d, ok := v.(*time.Duration); ok {
+		var s string
+		if json.Unmarshal(b, &s) != nil {
+			return fmt.Errorf("expected duration string, e.g. \"500ms\", "+
+				"but got %s", b)
+		}
+		var err error
+		*d, err = time.ParseDuration(s)
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jsonKind returns the JSON type name for the kind
+func jsonKind(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Slice:
+		return "array"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int64:
+		return "number"
+	}
+	return kind.String()
+}
+
+// configPath returns the path to the config file,
+// or an empty string if the default config file does not exist
+func (in *CmdIn) configPath() (string, error) {
+	if in.Config != "" {
+		return in.Config, nil
+	}
+	dir := in.BaseDir
+	if dir == "" {
+		dir = os.Getenv("APP_DIR")
+	}
+	if dir == "" {
+		var err error
+		dir, err = os.Getwd()
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+	p := filepath.Join(dir, ConfigFile)
+	_, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.WithStack(err)
+	}
+	return p, nil
+}
+
+// LoadConfig sets fields from the config file.
+// Fields set with flags in fs are not overridden
+func (in *CmdIn) LoadConfig(fs *flag.FlagSet) error {
+	p, err := in.configPath()
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return nil
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.Debug().Str("path", p).Msg("Load config")
+	return in.ParseConfig(p, b, in.flagsSet(fs))
+}
+
+// ParseConfig sets fields from the JSON config, except for the keys in skip.
+// Errors include the name of the config file and the key
+func (in *CmdIn) ParseConfig(name string, b []byte, skip map[string]bool) error {
+	values := make(map[string]json.RawMessage)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	err := decoder.Decode(&values)
+	if err != nil {
+		return errors.WithStack(fmt.Errorf("config %v: %v", name, err))
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := in.configFields()
+	for _, key := range keys {
+		if key == configTasks {
+			// Tasks copy the other options, see parseTasks
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			return errors.WithStack(
+				fmt.Errorf("config %v: unknown key %q", name, key))
+		}
+		// Decode into a new value so the field is not modified on error
+		v := reflect.New(field.Type())
+		err = unmarshal(values[key], v.Interface())
+		if err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				err = fmt.Errorf("expected %v but got %v",
+					jsonKind(field.Type().Kind()), typeErr.Value)
+			}
+			return errors.WithStack(
+				fmt.Errorf("config %v: invalid value for key %q: %v",
+					name, key, err))
+		}
+		if skip[key] {
+			log.Debug().Str("key", key).Msg("Config overridden by flag")
+			continue
+		}
+		field.Set(v.Elem())
+	}
+
+	if b, ok := values[configTasks]; ok {
+		return in.parseTasks(name, b, skip)
+	}
+	return nil
+}
+
+// configTasks is the config key for tasks
+const configTasks = "tasks"
+
+// Task returns a copy of the options, for a task to override
+func (in *CmdIn) Task() *CmdIn {
+	task := *in
+	task.Name = ""
+	task.Tasks = nil
+	task.ignore = nil
+	task.filters = nil
+	return &task
+}
+
+// parseTasks sets the tasks from the JSON array.
+// Each task starts with a copy of the options,
+// keys set for the task override the options, except for the keys in skip
+func (in *CmdIn) parseTasks(name string, b []byte, skip map[string]bool) error {
+	var values []json.RawMessage
+	err := json.Unmarshal(b, &values)
+	if err != nil {
+		return errors.WithStack(
+			fmt.Errorf("config %v: invalid value for key %q: "+
+				"expected array of objects", name, configTasks))
+	}
+
+	tasks := make([]*CmdIn, 0, len(values))
+	names := make(map[string]bool)
+	for i, value := range values {
+		task := in.Task()
+		err = task.ParseConfig(fmt.Sprintf("%v task %v", name, i), value, skip)
+		if err != nil {
+			return err
+		}
+		if task.Name == "" {
+			return errors.WithStack(
+				fmt.Errorf("config %v: task %v has no name", name, i))
+		}
+		if names[task.Name] {
+			return errors.WithStack(
+				fmt.Errorf("config %v: duplicate task %q", name, task.Name))
+		}
+		names[task.Name] = true
+		if len(task.Tasks) > 0 {
+			return errors.WithStack(
+				fmt.Errorf("config %v: task %q can't have tasks",
+					name, task.Name))
+		}
+		tasks = append(tasks, task)
+	}
+	in.Tasks = tasks
+	return nil
+}
@@ -0,0 +1,98 @@
+package watcher
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	in := NewCmdIn()
+	err := in.ParseConfig("watcher.json", []byte(`{
+		"dirs": ["src"],
+		"recursive": true,
+		"delay": 500,
+		"poll": "250ms"
+	}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(in.WatchDirs, ",") != "src" || !in.Recursive ||
+		in.Delay != 500 || in.Poll != 250*time.Millisecond {
+		t.Fatalf("unexpected options %+v", in)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`{"foo": 1}`,
+			`config watcher.json: unknown key "foo"`},
+		{`{"delay": "500"}`,
+			`config watcher.json: invalid value for key "delay": ` +
+				`expected number but got string`},
+		{`{"dirs": "src"}`,
+			`config watcher.json: invalid value for key "dirs": ` +
+				`expected array but got string`},
+		// Numbers would be nanoseconds
+		{`{"poll": 500}`,
+			`config watcher.json: invalid value for key "poll": ` +
+				`expected duration string, e.g. "500ms", but got 500`},
+		{`{"timeout": "1x"}`,
+			`config watcher.json: invalid value for key "timeout": `},
+		{`[]`, `config watcher.json: `},
+	}
+	for _, test := range tests {
+		in := NewCmdIn()
+		err := in.ParseConfig("watcher.json", []byte(test.config), nil)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("config %v error %v, expected %v",
+				test.config, err, test.err)
+		}
+	}
+}
+
+func TestLoadConfigFlags(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "watcher.json")
+	err := os.WriteFile(p, []byte(`{
+		"delay": 500, "recursive": true, "cmd": "make",
+		"tasks": [{"name": "web", "delay": 3000, "cmd": "npm test"}]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := NewCmdIn()
+	fs := flag.NewFlagSet("watcher", flag.ContinueOnError)
+	in.Flags(fs)
+	err = fs.Parse([]string{"-config", p, "-d", "100", "-cmd", "go test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = in.LoadConfig(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags override the config file
+	if in.Delay != 100 || in.Command != "go test" {
+		t.Fatalf("flags overridden by config, delay %v cmd %v",
+			in.Delay, in.Command)
+	}
+	if !in.Recursive {
+		t.Fatal("expected recursive from config")
+	}
+	// Flags override the config file for tasks too
+	if len(in.Tasks) != 1 {
+		t.Fatalf("tasks %v, expected 1", len(in.Tasks))
+	}
+	task := in.Tasks[0]
+	if task.Delay != 100 || task.Command != "go test" || !task.Recursive {
+		t.Fatalf("flags overridden by task config, delay %v cmd %v",
+			task.Delay, task.Command)
+	}
+}
@@ -0,0 +1,173 @@
+package watcher
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// DoctorTimeout is how long to wait for the test event in each root
+const DoctorTimeout = 2 * time.Second
+
+// unreliableFS are known to miss events
+var unreliableFS = map[string]bool{
+	"nfs":       true,
+	"overlayfs": true,
+	"fuse":      true,
+	"9p":        true,
+	"vboxsf":    true,
+	"cifs":      true,
+	"smb2":      true,
+}
+
+// inotifyLimits are reported by the doctor command
+var inotifyLimits = []string{
+	"max_user_watches",
+	"max_user_instances",
+	"max_queued_events",
+}
+
+// Doctor checks the environment before watching, and writes a report.
+// Returns the number of problems found
+func (in *CmdIn) Doctor(w io.Writer) (problems int, err error) {
+	problem := func(format string, a ...interface{}) {
+		problems++
+		fmt.Fprintf(w, "  PROBLEM "+format+"\n", a...)
+	}
+
+	fmt.Fprintf(w, "inotify limits\n")
+	for _, name := range inotifyLimits {
+		limit, err := InotifyLimit(name)
+		if err != nil {
+			fmt.Fprintf(w, "  %v unknown\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "  %v %v\n", name, limit)
+	}
+
+	roots := in.Roots()
+	if len(roots) == 0 {
+		fmt.Fprintf(w, "no dirs to watch\n")
+		problems++
+	}
+	watches := 0
+	for _, root := range roots {
+		fmt.Fprintf(w, "%v\n", root)
+
+		info, err := os.Stat(root)
+		if err != nil {
+			problem("%v", err)
+			continue
+		}
+		if !info.IsDir() {
+			problem("not a dir")
+			continue
+		}
+
+		fsType, err := FSType(root)
+		if err != nil {
+			problem("filesystem type: %v", err)
+		} else if unreliableFS[fsType] {
+			problem("filesystem type %v is known to miss events, "+
+				"consider -poll", fsType)
+		} else {
+			fmt.Fprintf(w, "  filesystem type %v\n", fsType)
+		}
+
+		// Same walk as for watching, without the limit
+		dirs := 1
+		if in.Recursive {
+			err = in.WalkDirs(root, root, func(dir string) error {
+				_, err := os.ReadDir(dir)
+				if err != nil {
+					problem("can't read %v", err)
+					return filepath.SkipDir
+				}
+				dirs++
+				return nil
+			})
+			if err != nil {
+				problem("walk failed: %v", err)
+			}
+			if dirs-1 > in.Limit {
+				problem("%v sub dirs, only %v will be watched, "+
+					"increase -l or exclude dirs", dirs-1, in.Limit)
+			} else {
+				fmt.Fprintf(w, "  %v sub dirs, limit %v\n", dirs-1, in.Limit)
+			}
+		}
+		if dirs-1 > in.Limit {
+			dirs = in.Limit + 1
+		}
+		watches += dirs
+
+		err = probe(root)
+		if err != nil {
+			problem("%v", err)
+		} else {
+			fmt.Fprintf(w, "  events received\n")
+		}
+	}
+
+	limit, err := InotifyLimit("max_user_watches")
+	if err == nil && watches > limit {
+		problems++
+		fmt.Fprintf(w, "PROBLEM %v watches needed, "+
+			"max_user_watches is %v\n", watches, limit)
+	}
+
+	if problems == 0 {
+		fmt.Fprintf(w, "no problems found\n")
+	} else {
+		fmt.Fprintf(w, "%v problems found\n", problems)
+	}
+	return problems, nil
+}
+
+// probe creates a temp file in the dir, and waits for the event
+func probe(dir string) (err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer (func() {
+		_ = watcher.Close()
+	})()
+	err = watcher.Add(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := os.CreateTemp(dir, ".watcher-doctor-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	defer (func() {
+		_ = os.Remove(name)
+	})()
+
+	timeout := time.After(DoctorTimeout)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.WithStack(fmt.Errorf("watcher closed"))
+			}
+			if event.Name == name {
+				return nil
+			}
+		case err := <-watcher.Errors:
+			return errors.WithStack(err)
+		case <-timeout:
+			return errors.WithStack(fmt.Errorf(
+				"no event received within %v for %v", DoctorTimeout, name))
+		}
+	}
+}
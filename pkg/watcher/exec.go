@@ -0,0 +1,436 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultStopTimeout is how long to wait for the command to exit,
+// after it was signalled to stop, before killing it
+const DefaultStopTimeout = 5 * time.Second
+
+// DefaultStopSignal is sent to stop the command
+const DefaultStopSignal = syscall.SIGTERM
+
+// ParseSignal returns the signal for the name, e.g. SIGTERM or TERM
+func ParseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return sig, errors.WithStack(fmt.Errorf("invalid signal %v", name))
+	}
+	return sig, nil
+}
+
+// signalName returns the name of the signal, e.g. SIGTERM
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// Policies for changes that arrive while the command is running
+const (
+	// OnBusyRestart stops the command, and starts it again
+	OnBusyRestart = "restart"
+	// OnBusyQueue runs the command once more after it exits,
+	// with the changes that arrived in the meantime
+	OnBusyQueue = "queue"
+	// OnBusySkip drops the changes
+	OnBusySkip = "skip"
+	// OnBusyParallel starts another command, up to the parallel limit,
+	// changes over the limit are queued
+	OnBusyParallel = "parallel"
+)
+
+// Runner starts the command, and runs it again on change
+type Runner struct {
+	// Command is executed with the shell,
+	// placeholders are replaced with values from the changes
+	Command string
+	// Stages are run in order before the command,
+	// the command is only started if all stages passed
+	Stages []string
+	// BaseDir for the {relpath} placeholder
+	BaseDir string
+	// Name of the task, output lines are prefixed with the name if set
+	Name string
+	// OnBusy is the policy for changes while the command is running
+	OnBusy string
+	// Parallel is the max number of commands running at once,
+	// if the policy is parallel
+	Parallel int
+	// StopSignal is sent to the process group of the command to stop it
+	StopSignal syscall.Signal
+	// StopTimeout to wait for the command to exit before killing it
+	StopTimeout time.Duration
+
+	mu sync.Mutex
+	// runs that have not exited
+	runs map[*run]bool
+	// queued changes to run when a command exits
+	queued []Change
+	// stopped is set by Stop, queued changes are not run
+	stopped bool
+}
+
+// run is started for each change, either the command,
+// or the stages followed by the command
+type run struct {
+	done chan struct{}
+
+	mu sync.Mutex
+	// proc is the last process started for the run
+	proc *process
+	// serving is set once the command is started
+	serving bool
+	// stopped is set by stop, no more processes are started
+	stopped bool
+}
+
+// isServing returns true if the command was started for the run
+func (ru *run) isServing() bool {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	return ru.serving
+}
+
+// process is a started shell command
+type process struct {
+	cmd     *exec.Cmd
+	command string
+	// stdout and stderr are set if output is prefixed
+	stdout *prefixWriter
+	stderr *prefixWriter
+}
+
+func NewRunner(command string) *Runner {
+	return &Runner{
+		Command:     command,
+		OnBusy:      OnBusyRestart,
+		Parallel:    1,
+		StopSignal:  DefaultStopSignal,
+		StopTimeout: DefaultStopTimeout,
+	}
+}
+
+// Start the command, output is streamed to stdout and stderr.
+// Placeholders and env vars for the changes are empty
+func (r *Runner) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = false
+	return r.start(nil)
+}
+
+// start a run for the changes, must be called with the lock held
+func (r *Runner) start(changes []Change) error {
+	ru := &run{done: make(chan struct{})}
+	if len(r.Stages) == 0 {
+		p, err := r.startProcess(r.Command, changes)
+		if err != nil {
+			return err
+		}
+		ru.proc = p
+		ru.serving = true
+	}
+
+	if r.runs == nil {
+		r.runs = make(map[*run]bool)
+	}
+	r.runs[ru] = true
+	go (func() {
+		if ru.proc != nil {
+			r.wait(ru.proc)
+		} else {
+			r.pipeline(ru, changes)
+		}
+		// Close before taking the lock
+		close(ru.done)
+		r.exited(ru)
+	})()
+	return nil
+}
+
+// event adds the task name to the log event, if set
+func (r *Runner) event(e *zerolog.Event) *zerolog.Event {
+	if r.Name != "" {
+		return e.Str("task", r.Name)
+	}
+	return e
+}
+
+// startProcess starts the shell command for the changes,
+// output is streamed to stdout and stderr
+func (r *Runner) startProcess(command string, changes []Change) (
+	p *process, err error) {
+
+	command = ExpandCommand(command, r.BaseDir, changes)
+	cmd := exec.Command("sh", "-c", command)
+	// Stdin is not set, the command runs in a background process group,
+	// and would be stopped with SIGTTIN if it read from the terminal
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	p = &process{cmd: cmd, command: command}
+	if r.Name != "" {
+		p.stdout = newPrefixWriter(os.Stdout, Prefix(r.Name))
+		p.stderr = newPrefixWriter(os.Stderr, Prefix(r.Name))
+		cmd.Stdout, cmd.Stderr = p.stdout, p.stderr
+	}
+	cmd.Env = append(os.Environ(), CommandEnv(changes)...)
+	// Stop the command and its children together
+	setProcessGroup(cmd)
+
+	r.event(log.Debug()).Str("cmd", command).Msg("Start command")
+	err = cmd.Start()
+	if err != nil {
+		return p, errors.WithStack(err)
+	}
+	return p, nil
+}
+
+// wait for the process to exit, and return the exit code.
+// The exit code is -1 if the process was terminated by a signal
+func (r *Runner) wait(p *process) int {
+	cmd := p.cmd
+	_ = cmd.Wait()
+	if p.stdout != nil {
+		// Last line without a newline
+		_ = p.stdout.Flush()
+		_ = p.stderr.Flush()
+	}
+	r.event(log.Info()).Str("cmd", p.command).Int("pid", cmd.Process.Pid).
+		Int("exitCode", cmd.ProcessState.ExitCode()).
+		Str("state", cmd.ProcessState.String()).
+		Msg("Command exited")
+	return cmd.ProcessState.ExitCode()
+}
+
+// exited removes the run, and starts the queued changes if any
+func (r *Runner) exited(ru *run) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.runs[ru] {
+		// Removed by stop
+		return
+	}
+	delete(r.runs, ru)
+	if r.queued == nil || r.stopped || !r.available() {
+		return
+	}
+	changes := r.queued
+	r.queued = nil
+	err := r.start(changes)
+	if err != nil {
+		r.event(log.Error()).Stack().Err(err).Str("cmd", r.Command).
+			Msg("Start queued command")
+	}
+}
+
+// available returns true if the policy allows starting another command.
+// Must be called with the lock held
+func (r *Runner) available() bool {
+	if r.OnBusy == OnBusyParallel {
+		return len(r.runs) < r.Parallel
+	}
+	return len(r.runs) == 0
+}
+
+// Change runs the command for the changes, according to the policy.
+// With stages, restart only stops runs that did not start the command yet,
+// the command is restarted once the stages passed
+func (r *Runner) Change(changes []Change) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return nil
+	}
+	switch r.OnBusy {
+	case OnBusyQueue, OnBusyParallel:
+		if !r.available() {
+			r.event(log.Debug()).Str("cmd", r.Command).
+				Int("running", len(r.runs)).Msg("Queue change")
+			r.queued = mergeChanges(r.queued, changes)
+			return nil
+		}
+	case OnBusySkip:
+		if !r.available() {
+			r.event(log.Debug()).Str("cmd", r.Command).Msg("Skip change")
+			return nil
+		}
+	default:
+		runs := r.remove(func(ru *run) bool {
+			return len(r.Stages) == 0 || !ru.isServing()
+		})
+		err := r.unlocked(func() error {
+			return r.stopRuns(runs)
+		})
+		if err != nil {
+			return err
+		}
+		if r.stopped {
+			return nil
+		}
+	}
+	return r.start(changes)
+}
+
+// remove the runs matching the filter, must be called with the lock held
+func (r *Runner) remove(filter func(ru *run) bool) (runs []*run) {
+	for ru := range r.runs {
+		if filter(ru) {
+			delete(r.runs, ru)
+			runs = append(runs, ru)
+		}
+	}
+	return runs
+}
+
+// unlocked calls fn without the lock held,
+// runs may need the lock before they are done
+func (r *Runner) unlocked(fn func() error) error {
+	r.mu.Unlock()
+	defer r.mu.Lock()
+	return fn()
+}
+
+// mergeChanges coalesces the changes into one batch,
+// ops are combined for paths in both, and next is ordered last
+func mergeChanges(prev, next []Change) []Change {
+	ops := make(map[string]fsnotify.Op, len(prev))
+	for _, change := range prev {
+		ops[change.Path] |= change.Op
+	}
+	inNext := make(map[string]bool, len(next))
+	for _, change := range next {
+		inNext[change.Path] = true
+	}
+	merged := make([]Change, 0, len(prev)+len(next))
+	for _, change := range prev {
+		if !inNext[change.Path] {
+			merged = append(merged, change)
+		}
+	}
+	for _, change := range next {
+		change.Op |= ops[change.Path]
+		merged = append(merged, change)
+	}
+	return merged
+}
+
+// Stop the commands that are running, and drop queued changes.
+// The commands are sent the stop signal,
+// and killed if they don't exit within the stop timeout
+func (r *Runner) Stop() error {
+	r.mu.Lock()
+	r.stopped = true
+	r.queued = nil
+	runs := r.remove(func(ru *run) bool { return true })
+	r.mu.Unlock()
+	return r.stopRuns(runs)
+}
+
+// stopRuns stops the runs, must be called without the lock held
+func (r *Runner) stopRuns(runs []*run) error {
+	for _, ru := range runs {
+		err := r.stop(ru)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop the process group of the last process started for the run
+// with the stop signal, and kill the group if it doesn't exit in time
+func (r *Runner) stop(ru *run) error {
+	ru.mu.Lock()
+	ru.stopped = true
+	p, done := ru.proc, ru.done
+	ru.mu.Unlock()
+
+	select {
+	case <-done:
+		// Already exited
+		return nil
+	default:
+	}
+	if p == nil {
+		// No process started yet
+		<-done
+		return nil
+	}
+	cmd := p.cmd
+
+	sig := r.StopSignal
+	if sig == 0 {
+		sig = DefaultStopSignal
+	}
+	timeout := r.StopTimeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+	pid := cmd.Process.Pid
+	start := time.Now()
+	r.event(log.Info()).Str("cmd", p.command).Int("pid", pid).
+		Str("signal", signalName(sig)).Dur("timeout", timeout).
+		Msg("Stop command")
+	err := signalProcessGroup(cmd.Process, sig)
+	if err != nil {
+		r.event(log.Error()).Err(err).Str("cmd", p.command).Int("pid", pid).
+			Str("signal", signalName(sig)).Msg("Signal failed")
+		return errors.WithStack(err)
+	}
+
+	if waitGroup(cmd.Process, done, timeout) {
+		r.event(log.Info()).Str("cmd", p.command).Int("pid", pid).
+			Dur("elapsed", time.Since(start)).Msg("Command stopped")
+		return nil
+	}
+	r.event(log.Warn()).Str("cmd", p.command).Int("pid", pid).
+		Dur("timeout", timeout).Msg("Stop timeout, killing command")
+	err = signalProcessGroup(cmd.Process, syscall.SIGKILL)
+	if err != nil {
+		r.event(log.Error()).Err(err).Str("cmd", p.command).Int("pid", pid).
+			Msg("Kill failed")
+		return errors.WithStack(err)
+	}
+	<-done
+	r.event(log.Info()).Str("cmd", p.command).Int("pid", pid).
+		Dur("elapsed", time.Since(start)).Msg("Command killed")
+	return nil
+}
+
+// waitGroup waits for the command to exit, and the other processes
+// in its group, e.g. children started in the background by the shell.
+// Returns false if the timeout passed first
+func waitGroup(p *os.Process, done chan struct{}, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	select {
+	case <-done:
+	case <-deadline:
+		return false
+	}
+	for processGroupAlive(p) {
+		select {
+		case <-deadline:
+			return false
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// runOnBusy runs the command for changes debounced by the watcher,
+// with changes to a, b and c arriving while the first command is running.
+// Returns the lines logged by the commands
+func runOnBusy(t *testing.T, onBusy string, parallel int) []string {
+	t.Helper()
+	w, dir := newTestWatcher(t, 50)
+	logFile := filepath.Join(t.TempDir(), "log")
+
+	// Each run logs the paths on start and on end
+	r := NewRunner(fmt.Sprintf(
+		"echo start {paths} >> %[1]v; sleep 0.5; echo end >> %[1]v",
+		ShellQuote(logFile)))
+	r.OnBusy = onBusy
+	r.Parallel = parallel
+	w.OnChange = r.Change
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go (func() {
+		done <- w.Run(ctx)
+	})()
+
+	// a starts the first run after the delay,
+	// b and c are delivered separately while it's running
+	for _, name := range []string{"a", "b", "c"} {
+		w.events <- fsnotify.Event{
+			Name: filepath.Join(dir, name), Op: fsnotify.Write}
+		time.Sleep(150 * time.Millisecond)
+	}
+	time.Sleep(1200 * time.Millisecond)
+
+	cancel()
+	err := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	for i, line := range lines {
+		// Paths relative to the watched dir
+		lines[i] = strings.ReplaceAll(line, dir+string(filepath.Separator), "")
+	}
+	return lines
+}
+
+// maxRunning returns the max number of runs started and not ended
+func maxRunning(lines []string) (max int) {
+	running := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "start") {
+			running++
+		} else {
+			running--
+		}
+		if running > max {
+			max = running
+		}
+	}
+	return max
+}
+
+func assertLines(t *testing.T, lines, expected []string) {
+	t.Helper()
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("lines\n%v\nexpected\n%v",
+			strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestRunnerOnBusyRestart(t *testing.T) {
+	t.Parallel()
+	lines := runOnBusy(t, OnBusyRestart, 1)
+	// Runs for a and b are stopped before they end
+	assertLines(t, lines, []string{"start a", "start b", "start c", "end"})
+}
+
+func TestRunnerOnBusyQueue(t *testing.T) {
+	t.Parallel()
+	lines := runOnBusy(t, OnBusyQueue, 1)
+	// b and c are coalesced into one run after a
+	assertLines(t, lines, []string{"start a", "end", "start b c", "end"})
+}
+
+func TestRunnerOnBusySkip(t *testing.T) {
+	t.Parallel()
+	lines := runOnBusy(t, OnBusySkip, 1)
+	assertLines(t, lines, []string{"start a", "end"})
+}
+
+func TestRunnerOnBusyParallel(t *testing.T) {
+	t.Parallel()
+	lines := runOnBusy(t, OnBusyParallel, 2)
+	// c is queued until a ends
+	assertLines(t, lines[:2], []string{"start a", "start b"})
+	if n := maxRunning(lines); n != 2 {
+		t.Fatalf("max running %v, expected 2\n%v", n, strings.Join(lines, "\n"))
+	}
+	starts := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "start") {
+			starts++
+		}
+	}
+	if starts != 3 || len(lines) != 6 {
+		t.Fatalf("expected 3 runs\n%v", strings.Join(lines, "\n"))
+	}
+}
+
+func TestMergeChanges(t *testing.T) {
+	merged := mergeChanges(
+		[]Change{{Path: "a", Op: fsnotify.Create}, {Path: "b"}},
+		[]Change{{Path: "a", Op: fsnotify.Write}, {Path: "c"}})
+	paths := make([]string, 0, len(merged))
+	for _, change := range merged {
+		paths = append(paths, change.Path)
+	}
+	if strings.Join(paths, " ") != "b a c" {
+		t.Fatalf("unexpected order %v", paths)
+	}
+	if merged[1].Op != fsnotify.Create|fsnotify.Write {
+		t.Fatalf("unexpected op %v", merged[1].Op)
+	}
+}
+
+// runPipeline runs the stages and command once for a change to a,
+// and returns the lines logged by them
+func runPipeline(t *testing.T, stages []string, command string) []string {
+	t.Helper()
+	logFile := ShellQuote(filepath.Join(t.TempDir(), "log"))
+	for i, stage := range stages {
+		stages[i] = fmt.Sprintf(stage, logFile)
+	}
+	r := NewRunner(fmt.Sprintf(command, logFile))
+	r.Stages = stages
+	err := r.Change([]Change{{Path: "a", Op: fsnotify.Write}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		r.mu.Lock()
+		running := len(r.runs)
+		r.mu.Unlock()
+		if running == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected pipeline to exit")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	b, err := os.ReadFile(strings.Trim(logFile, "'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestRunnerPipeline(t *testing.T) {
+	t.Parallel()
+	lines := runPipeline(t, []string{
+		"echo build {paths} >> %v",
+		"echo test >> %v",
+	}, "echo run >> %v")
+	assertLines(t, lines, []string{"build a", "test", "run"})
+}
+
+func TestRunnerPipelineFailed(t *testing.T) {
+	t.Parallel()
+	// Stages after the one that failed, and the command, are skipped
+	lines := runPipeline(t, []string{
+		"echo build >> %v",
+		"echo test >> %v; false",
+		"echo lint >> %v",
+	}, "echo run >> %v")
+	assertLines(t, lines, []string{"build", "test"})
+}
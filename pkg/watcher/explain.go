@@ -0,0 +1,128 @@
+package watcher
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Explain writes how the path is evaluated against the watched roots,
+// hidden dir skipping, the dir and file filters, and the limit.
+// Returns true if changes to the path would be included
+func (in *CmdIn) Explain(w io.Writer, p string) (included bool, err error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(in.BaseDir, p)
+	}
+	p = filepath.Clean(p)
+	fmt.Fprintf(w, "path %v\n", p)
+
+	// Longest root covering the path, like Tree.Root
+	var root string
+	for _, r := range in.Roots() {
+		r = filepath.Clean(r)
+		if len(r) > len(root) &&
+			(p == r || strings.HasPrefix(p, r+string(filepath.Separator))) {
+			root = r
+		}
+	}
+	if root == "" {
+		fmt.Fprintf(w, "no root covers the path, roots are %v\n",
+			strings.Join(in.Roots(), ", "))
+		return false, nil
+	}
+	fmt.Fprintf(w, "root %v\n", root)
+
+	rule, err := in.DirRule(root, root)
+	if err != nil {
+		return false, err
+	}
+	if rule != "" {
+		fmt.Fprintf(w, "root excluded by %v\n", rule)
+		return false, nil
+	}
+
+	// Dirs between the root and the path must be watched
+	var dirs []string
+	dir := filepath.Dir(p)
+	for dir != root && len(dir) > len(root) {
+		dirs = append([]string{dir}, dirs...)
+		dir = filepath.Dir(dir)
+	}
+	if len(dirs) > 0 && !in.Recursive {
+		fmt.Fprintf(w, "dir %v not watched, -r is not set\n", dirs[0])
+		return false, nil
+	}
+	var watched map[string]bool
+	var limited bool
+	for _, dir := range dirs {
+		if strings.HasPrefix(filepath.Base(dir), ".") {
+			fmt.Fprintf(w, "dir %v skipped, hidden dir\n", dir)
+			return false, nil
+		}
+		rule, err := in.DirRule(root, dir)
+		if err != nil {
+			return false, err
+		}
+		if rule != "" {
+			fmt.Fprintf(w, "dir %v excluded by %v\n", dir, rule)
+			return false, nil
+		}
+		if watched == nil {
+			var listed []string
+			listed, limited, err = in.listDirs(root)
+			if err != nil {
+				return false, err
+			}
+			watched = make(map[string]bool, len(listed))
+			for _, d := range listed {
+				watched[d] = true
+			}
+		}
+		if watched[dir] {
+			fmt.Fprintf(w, "dir %v watched\n", dir)
+			continue
+		}
+		if limited {
+			fmt.Fprintf(w, "dir %v not watched, limit of %v sub dirs "+
+				"reached, see -l\n", dir, in.Limit)
+			return false, nil
+		}
+		_, err = os.Stat(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return false, errors.WithStack(err)
+			}
+			fmt.Fprintf(w, "dir %v does not exist yet, "+
+				"it's watched when created\n", dir)
+			continue
+		}
+		fmt.Fprintf(w, "dir %v not watched\n", dir)
+		return false, nil
+	}
+
+	if p == root {
+		// Events for the root itself are checked against the file filters
+		fmt.Fprintf(w, "path is the root\n")
+	}
+	_, err = os.Lstat(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, errors.WithStack(err)
+		}
+		fmt.Fprintf(w, "path does not exist yet\n")
+	}
+	included, rule, err = in.FileRule(root, p)
+	if err != nil {
+		return false, err
+	}
+	if included {
+		fmt.Fprintf(w, "included by %v\n", rule)
+	} else {
+		fmt.Fprintf(w, "excluded by %v\n", rule)
+	}
+	return included, nil
+}
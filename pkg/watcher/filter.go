@@ -0,0 +1,90 @@
+package watcher
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// pattern is a compiled filter pattern
+type pattern struct {
+	// flag the pattern was specified with
+	flag string
+	// pattern as specified
+	pattern string
+	re      *regexp.Regexp
+}
+
+// String returns the flag and pattern, e.g. -exclude ".*.go$"
+func (p pattern) String() string {
+	return fmt.Sprintf("-%v %q", p.flag, p.pattern)
+}
+
+// filters are compiled once by Prepare, and reused for each path
+type filters struct {
+	includeFiles    []pattern
+	excludeFiles    []pattern
+	excludeDirs     []pattern
+	includeGlobs    []pattern
+	excludeGlobs    []pattern
+	excludeDirGlobs []pattern
+}
+
+// compilePatterns compiles regexp or glob patterns,
+// the error names the flag and the invalid pattern
+func compilePatterns(flag string, patterns []string, glob bool) (
+	compiled []pattern, err error) {
+
+	compiled = make([]pattern, 0, len(patterns))
+	for _, p := range patterns {
+		expr := p
+		if glob {
+			expr, err = GlobRegexp(p)
+			if err != nil {
+				return compiled, errors.WithStack(
+					fmt.Errorf("invalid -%v pattern %q: %v", flag, p, err))
+			}
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return compiled, errors.WithStack(
+				fmt.Errorf("invalid -%v pattern %q: %v", flag, p, err))
+		}
+		compiled = append(compiled, pattern{flag: flag, pattern: p, re: re})
+	}
+	return compiled, nil
+}
+
+// compileFilters compiles the patterns for all filter flags
+func (in *CmdIn) compileFilters() (f *filters, err error) {
+	f = &filters{}
+	for _, c := range []struct {
+		compiled *[]pattern
+		flag     string
+		patterns []string
+		glob     bool
+	}{
+		{&f.includeFiles, "include", in.IncludeFiles, false},
+		{&f.excludeFiles, "exclude", in.ExcludeFiles, false},
+		{&f.excludeDirs, "excludeDir", in.ExcludeDirs, false},
+		{&f.includeGlobs, "includeGlob", in.IncludeGlobs, true},
+		{&f.excludeGlobs, "excludeGlob", in.ExcludeGlobs, true},
+		{&f.excludeDirGlobs, "excludeDirGlob", in.ExcludeDirGlobs, true},
+	} {
+		*c.compiled, err = compilePatterns(c.flag, c.patterns, c.glob)
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// getFilters returns the filters compiled by Prepare,
+// or compiles them if Prepare was not called
+func (in *CmdIn) getFilters() (*filters, error) {
+	if in.filters != nil {
+		return in.filters, nil
+	}
+	return in.compileFilters()
+}
@@ -0,0 +1,43 @@
+package watcher
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrepareInvalidPatterns(t *testing.T) {
+	tests := []struct {
+		set func(in *CmdIn)
+		err string
+	}{
+		{func(in *CmdIn) { in.IncludeFiles = MultiFlag{".*.go$", "(a"} },
+			`invalid -include pattern "(a": `},
+		{func(in *CmdIn) { in.ExcludeFiles = MultiFlag{"*.go"} },
+			`invalid -exclude pattern "*.go": `},
+		{func(in *CmdIn) { in.ExcludeDirs = MultiFlag{"[a"} },
+			`invalid -excludeDir pattern "[a": `},
+		{func(in *CmdIn) { in.IncludeGlobs = MultiFlag{"[ab"} },
+			`invalid -includeGlob pattern "[ab": `},
+		{func(in *CmdIn) { in.ExcludeGlobs = MultiFlag{"**/[x"} },
+			`invalid -excludeGlob pattern "**/[x": `},
+		{func(in *CmdIn) { in.ExcludeDirGlobs = MultiFlag{"a/[b"} },
+			`invalid -excludeDirGlob pattern "a/[b": `},
+	}
+	for _, test := range tests {
+		in := NewCmdIn()
+		test.set(in)
+		err := in.Prepare()
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("error %v, expected %v", err, test.err)
+		}
+	}
+
+	// Valid patterns
+	in := NewCmdIn()
+	in.IncludeFiles = MultiFlag{".*.go$"}
+	in.ExcludeDirGlobs = MultiFlag{"**/node_modules"}
+	err := in.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
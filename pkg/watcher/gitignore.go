@@ -0,0 +1,211 @@
+package watcher
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// IgnoreFiles are loaded from each dir, in order of precedence (lowest first)
+var IgnoreFiles = []string{".gitignore", ".ignore"}
+
+// ignoreRule is a pattern from an ignore file
+type ignoreRule struct {
+	// pattern as it appears in the file
+	pattern string
+	// file the rule was loaded from
+	file string
+	// re is matched against the path relative to the dir of the ignore file
+	re *regexp.Regexp
+	// negate re-includes paths excluded by a previous rule
+	negate bool
+	// dirOnly rules only match dirs
+	dirOnly bool
+}
+
+// parseIgnoreRule parses a line from an ignore file,
+// ok is false for blank lines and comments
+func parseIgnoreRule(line string) (rule ignoreRule, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+	rule.pattern = line
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false, nil
+	}
+	if strings.Contains(line, "/") {
+		// Anchored to the dir of the ignore file
+		line = strings.TrimPrefix(line, "/")
+	} else if line != "**" {
+		// Match at any depth
+		line = "**/" + line
+	}
+	// Like git, a trailing "/**" matches the contents but not the dir,
+	// so negated rules can re-include paths inside it
+	contents := strings.HasSuffix(line, "/**")
+	if contents {
+		line = strings.TrimSuffix(line, "/**")
+	}
+	expr, err := GlobRegexp(line)
+	if err != nil {
+		return rule, false, errors.WithStack(err)
+	}
+	if contents {
+		expr = strings.TrimSuffix(expr, "$") + "/.+$"
+	}
+	rule.re, err = regexp.Compile(expr)
+	if err != nil {
+		return rule, false, errors.WithStack(err)
+	}
+	return rule, true, nil
+}
+
+// Ignore applies gitignore rules loaded from ignore files in the
+// watched roots and nested dirs, and .git/info/exclude in the roots
+type Ignore struct {
+	mu sync.Mutex
+	// rules per dir, loaded on first use
+	rules map[string][]ignoreRule
+}
+
+func NewIgnore() *Ignore {
+	return &Ignore{rules: make(map[string][]ignoreRule)}
+}
+
+// load the rules for dir, the lock must be held
+func (ig *Ignore) load(root, dir string) ([]ignoreRule, error) {
+	if rules, ok := ig.rules[dir]; ok {
+		return rules, nil
+	}
+	files := make([]string, 0, len(IgnoreFiles)+1)
+	if dir == root {
+		files = append(files, filepath.Join(dir, ".git", "info", "exclude"))
+	}
+	for _, name := range IgnoreFiles {
+		files = append(files, filepath.Join(dir, name))
+	}
+	rules := make([]ignoreRule, 0)
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return rules, errors.WithStack(err)
+		}
+		log.Debug().Str("path", file).Msg("Load ignore file")
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			rule, ok, err := parseIgnoreRule(scanner.Text())
+			if err != nil {
+				_ = f.Close()
+				return rules, errors.Wrapf(err, "ignore file %v", file)
+			}
+			if ok {
+				rule.file = file
+				rules = append(rules, rule)
+			}
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return rules, errors.WithStack(err)
+		}
+	}
+	ig.rules[dir] = rules
+	return rules, nil
+}
+
+// Reset drops the cached rules for dir,
+// e.g. after an ignore file in the dir changed
+func (ig *Ignore) Reset(dir string) {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	delete(ig.rules, dir)
+}
+
+// Ignored returns true if the path is ignored by the rules
+// in the root and the dirs between the root and the path.
+// Paths inside ignored dirs are ignored,
+// like git, negated rules can't re-include them
+func (ig *Ignore) Ignored(root, p string, isDir bool) (bool, error) {
+	rule, err := ig.IgnoredBy(root, p, isDir)
+	return rule != "", err
+}
+
+// IgnoredBy returns the rule that ignores the path, and the file it's in,
+// or an empty string if the path is not ignored
+func (ig *Ignore) IgnoredBy(root, p string, isDir bool) (string, error) {
+	rel := RelPath(root, p)
+	if root == "" || rel == "." || path.IsAbs(rel) {
+		// Not in the root
+		return "", nil
+	}
+
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+
+	segments := strings.Split(rel, "/")
+	for i := 1; i <= len(segments); i++ {
+		dir := i < len(segments) || isDir
+		rule, err := ig.match(root, segments[:i], dir)
+		if err != nil {
+			return "", err
+		}
+		if rule != nil {
+			return fmt.Sprintf("%q in %v", rule.pattern, rule.file), nil
+		}
+	}
+	return "", nil
+}
+
+// match the path, given as segments relative to the root,
+// against the rules in each dir above it. The last matching rule wins,
+// nil is returned if the path is not ignored
+func (ig *Ignore) match(root string, segments []string, isDir bool) (
+	ignored *ignoreRule, err error) {
+
+	dir := root
+	for i := 0; i < len(segments); i++ {
+		if i > 0 {
+			dir = filepath.Join(dir, segments[i-1])
+		}
+		rules, err := ig.load(root, dir)
+		if err != nil {
+			return nil, err
+		}
+		rel := strings.Join(segments[i:], "/")
+		for j, rule := range rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.re.MatchString(rel) {
+				if rule.negate {
+					ignored = nil
+				} else {
+					ignored = &rules[j]
+				}
+			}
+		}
+	}
+	return ignored, nil
+}
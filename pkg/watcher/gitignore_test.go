@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		p       string
+		match   bool
+		negate  bool
+		dirOnly bool
+	}{
+		{"*.log", "a.log", true, false, false},
+		{"*.log", "a/b.log", true, false, false},
+		{"!keep.log", "a/keep.log", true, true, false},
+		{`\!x`, "!x", true, false, false},
+		{"build/", "build", true, false, true},
+		{"build/", "a/build", true, false, true},
+		{"/build", "build", true, false, false},
+		{"/build", "a/build", false, false, false},
+		{"a/b", "a/b", true, false, false},
+		{"a/b", "x/a/b", false, false, false},
+		{"**/tmp", "a/b/tmp", true, false, false},
+		{"a/**/b", "a/x/y/b", true, false, false},
+		// The contents of the dir, but not the dir itself
+		{"docs/**", "docs/y.md", true, false, false},
+		{"docs/**", "docs/x/z.md", true, false, false},
+		{"docs/**", "docs", false, false, false},
+		{"**", "a/b", true, false, false},
+	}
+	for _, test := range tests {
+		rule, ok, err := parseIgnoreRule(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("rule %q expected ok", test.line)
+		}
+		if match := rule.re.MatchString(test.p); match != test.match {
+			t.Errorf("rule %q path %q match %v, expected %v",
+				test.line, test.p, match, test.match)
+		}
+		if rule.negate != test.negate || rule.dirOnly != test.dirOnly {
+			t.Errorf("rule %q negate %v dirOnly %v, expected %v %v",
+				test.line, rule.negate, rule.dirOnly, test.negate, test.dirOnly)
+		}
+	}
+
+	for _, line := range []string{"", "  ", "# comment", "/"} {
+		_, ok, err := parseIgnoreRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("line %q expected no rule", line)
+		}
+	}
+}
+
+func TestIgnoredBy(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore": "*.log\n!keep.log\nbuild/\n/tmp\n" +
+			"docs/**\n!docs/x/\n!docs/x/**\n",
+		"sub/.gitignore": "*.md\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		p       string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"a/b.log", false, true},
+		{"a/keep.log", false, false},
+		// Dir only
+		{"build", true, true},
+		{"build", false, false},
+		{"a/build/c.go", false, true},
+		// Anchored
+		{"tmp", true, true},
+		{"a/tmp", true, false},
+		// Nested ignore file
+		{"sub/a.md", false, true},
+		{"a.md", false, false},
+		// Negated inside a dir ignored with "/**"
+		{"docs", true, false},
+		{"docs/y.md", false, true},
+		{"docs/x", true, false},
+		{"docs/x/z.md", false, false},
+		// Negation can't re-include paths inside an ignored dir
+		{"build/keep.log", false, true},
+	}
+	ig := NewIgnore()
+	for _, test := range tests {
+		rule, err := ig.IgnoredBy(root, filepath.Join(root, test.p), test.isDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ignored := rule != ""; ignored != test.ignored {
+			t.Errorf("path %q ignored %v (%v), expected %v",
+				test.p, ignored, rule, test.ignored)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package watcher
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GlobRegexp converts the glob pattern to an anchored regexp.
+// Patterns are matched against slash separated paths:
+//   - "*" matches any sequence of characters except "/"
+//   - "?" matches any single character except "/"
+//   - "[abc]", "[a-z]" and "[!a-z]" match a character class
+//   - "**" matches zero or more path segments, e.g. "**/*.go"
+func GlobRegexp(pattern string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				atStart := i == 1 || pattern[i-2] == '/'
+				if atStart && i+1 < len(pattern) && pattern[i+1] == '/' {
+					// Zero or more dirs, e.g. "**/" or "a/**/b"
+					i++
+					b.WriteString("(?:.*/)?")
+				} else if atStart && i+1 == len(pattern) && i > 1 {
+					// Everything inside the dir, e.g. "a/**"
+					s := b.String()
+					b.Reset()
+					b.WriteString(strings.TrimSuffix(s, "/"))
+					b.WriteString("(?:/.*)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 1 {
+				return "", errors.WithStack(
+					fmt.Errorf("invalid glob %v: unterminated class", pattern))
+			}
+			class := pattern[i+1 : i+1+end]
+			b.WriteString("[")
+			if strings.HasPrefix(class, "!") {
+				b.WriteString("^")
+				class = class[1:]
+			}
+			b.WriteString(strings.ReplaceAll(class, `\`, `\\`))
+			b.WriteString("]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			} else {
+				b.WriteString(`\\`)
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+// MatchGlob reports whether the slash separated path matches the glob
+func MatchGlob(pattern, p string) (bool, error) {
+	expr, err := GlobRegexp(pattern)
+	if err != nil {
+		return false, err
+	}
+	match, err := regexp.MatchString(expr, p)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return match, nil
+}
+
+// RelPath returns the slash separated path relative to root,
+// e.g. the watched root that globs are matched against, or the base dir.
+// Paths outside root are not made relative with "..",
+// the slash separated path is returned instead
+func RelPath(root, p string) string {
+	if root == "" {
+		return filepath.ToSlash(p)
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return filepath.ToSlash(p)
+	}
+	return rel
+}
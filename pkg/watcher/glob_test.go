@@ -0,0 +1,73 @@
+package watcher
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		p       string
+		match   bool
+	}{
+		{"*.go", "a.go", true},
+		{"*.go", "a/b.go", false},
+		{"?.go", "a.go", true},
+		{"?.go", "ab.go", false},
+		{"[ab].go", "b.go", true},
+		{"[!ab].go", "b.go", false},
+		{"[a-c].go", "c.go", true},
+		{"**/*.go", "a.go", true},
+		{"**/*.go", "a/b/c.go", true},
+		{"**/*.go", "a/b/c.md", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "ab", false},
+		{"a/**", "a", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "ab", false},
+		{"**/node_modules", "node_modules", true},
+		{"**/node_modules", "web/node_modules", true},
+		{"a**b", "a/x/b", true},
+		{`\*.go`, "*.go", true},
+		{`\*.go`, "a.go", false},
+		{"a.go", "a_go", false},
+	}
+	for _, test := range tests {
+		match, err := MatchGlob(test.pattern, test.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != test.match {
+			t.Errorf("glob %q path %q match %v, expected %v",
+				test.pattern, test.p, match, test.match)
+		}
+	}
+}
+
+func TestMatchGlobInvalid(t *testing.T) {
+	_, err := MatchGlob("[ab", "a")
+	if err == nil {
+		t.Fatal("expected error for unterminated class")
+	}
+}
+
+func TestRelPath(t *testing.T) {
+	tests := []struct {
+		root string
+		p    string
+		rel  string
+	}{
+		{"/src", "/src/a/b.go", "a/b.go"},
+		{"/src", "/src", "."},
+		{"/src", "/src/..a.go", "..a.go"},
+		// Outside the root
+		{"/src", "/tmp/a.go", "/tmp/a.go"},
+		{"/src/a", "/src/b.go", "/src/b.go"},
+		{"", "/src/a.go", "/src/a.go"},
+	}
+	for _, test := range tests {
+		if rel := RelPath(test.root, test.p); rel != test.rel {
+			t.Errorf("root %q path %q rel %q, expected %q",
+				test.root, test.p, rel, test.rel)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// sharedWatcher counts the watches for each dir,
+// so a dir is only removed when no task watches it
+type sharedWatcher struct {
+	fs *fsnotify.Watcher
+
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+// Add the dir, the watch is updated even if another task watches the dir,
+// e.g. the dir was removed and created again
+func (s *sharedWatcher) Add(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.fs.Add(name)
+	if err != nil {
+		return err
+	}
+	s.refs[name]++
+	return nil
+}
+
+// Remove the dir once no task watches it
+func (s *sharedWatcher) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs[name] == 0 {
+		return nil
+	}
+	s.refs[name]--
+	if s.refs[name] > 0 {
+		return nil
+	}
+	delete(s.refs, name)
+	return s.fs.Remove(name)
+}
+
+// Group runs a watcher for each task, sharing a single fsnotify watcher.
+// Events are sent to all watchers, each watcher filters the events
+// with the options for the task
+type Group struct {
+	// Watchers in the same order as the tasks
+	Watchers []*Watcher
+
+	// fs is not set if the watcher could not be created,
+	// or all tasks are polled
+	fs   *fsnotify.Watcher
+	done chan struct{}
+}
+
+// NewGroup creates a watcher for each task and adds the dirs to watch,
+// changes are delivered once Run is called
+func NewGroup(tasks []*CmdIn) (g *Group, err error) {
+	g = &Group{done: make(chan struct{})}
+
+	for _, in := range tasks {
+		w, err := newWatcher(in)
+		if err != nil {
+			return g, errors.Wrapf(err, "task %v", in.Name)
+		}
+		w.shared = make(chan fsnotify.Event)
+		g.Watchers = append(g.Watchers, w)
+	}
+
+	// The shared watcher is required unless all tasks are polled
+	required, fallback := false, true
+	for _, w := range g.Watchers {
+		if w.in.Poll == 0 || w.in.PollFallback {
+			required = true
+			fallback = fallback && w.in.PollFallback
+		}
+	}
+	if required {
+		g.fs, err = fsnotify.NewWatcher()
+		if err != nil {
+			if !fallback {
+				return g, errors.WithStack(err)
+			}
+			log.Warn().Err(err).Msg("Watcher failed, falling back to polling")
+			g.fs = nil
+		}
+	}
+
+	var shared *sharedWatcher
+	if g.fs != nil {
+		shared = &sharedWatcher{fs: g.fs, refs: make(map[string]int)}
+		go g.forward()
+	}
+	for _, w := range g.Watchers {
+		in := w.in
+		var dirs DirWatcher
+		if shared != nil && (in.Poll == 0 || in.PollFallback) {
+			dirs = shared
+		}
+		err = w.watch(dirs)
+		if err != nil {
+			_ = g.Close()
+			return g, errors.Wrapf(err, "task %v", in.Name)
+		}
+	}
+	return g, nil
+}
+
+// forward events and errors from the shared watcher to all watchers
+func (g *Group) forward() {
+	for {
+		select {
+		case event, ok := <-g.fs.Events:
+			if !ok {
+				return
+			}
+			for _, w := range g.Watchers {
+				select {
+				case w.shared <- event:
+				case <-w.done:
+				case <-g.done:
+					return
+				}
+			}
+		case err, ok := <-g.fs.Errors:
+			if !ok {
+				return
+			}
+			for _, w := range g.Watchers {
+				if errors.Is(err, fsnotify.ErrEventOverflow) {
+					// Recoverable, rescan unless a rescan is already pending
+					select {
+					case w.rescans <- true:
+					default:
+					}
+					continue
+				}
+				w.error(err)
+			}
+		}
+	}
+}
+
+// Run the watchers until the context is done, or an error occurs.
+// The first error stops all watchers
+func (g *Group) Run(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(g.Watchers))
+	for _, w := range g.Watchers {
+		go (func(w *Watcher) {
+			err := w.Run(ctx)
+			if err != nil {
+				err = errors.Wrapf(err, "task %v", w.in.Name)
+			}
+			errs <- err
+		})(w)
+	}
+	for range g.Watchers {
+		runErr := <-errs
+		if runErr != nil && err == nil {
+			err = runErr
+			cancel()
+		}
+	}
+
+	closeErr := g.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close the shared watcher and all watchers,
+// this is done automatically when Run returns
+func (g *Group) Close() error {
+	select {
+	case <-g.done:
+		return nil
+	default:
+		close(g.done)
+	}
+	for _, w := range g.Watchers {
+		_ = w.Close()
+	}
+	if g.fs != nil {
+		return errors.WithStack(g.fs.Close())
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupTasks(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"web", "api"} {
+		err := os.Mkdir(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in := NewCmdIn()
+	in.BaseDir = dir
+	in.Recursive = true
+	in.Delay = 50
+	web := in.Task()
+	web.Name = "web"
+	web.WatchDirs = MultiFlag{"web"}
+	api := in.Task()
+	api.Name = "api"
+	api.WatchDirs = MultiFlag{"api"}
+	api.IncludeGlobs = MultiFlag{"**/*.go"}
+	// The whole dir, except for the api dir
+	all := in.Task()
+	all.Name = "all"
+	all.WatchDirs = MultiFlag{"."}
+	all.ExcludeDirGlobs = MultiFlag{"api"}
+
+	g, err := NewGroup([]*CmdIn{web, api, all})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go (func() {
+		done <- g.Run(ctx)
+	})()
+
+	for _, name := range []string{"web/a.js", "api/b.go", "api/c.md"} {
+		err = os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		"web": "web/a.js",
+		"api": "api/b.go",
+		"all": "web/a.js",
+	}
+	for i, w := range g.Watchers {
+		name := []string{"web", "api", "all"}[i]
+		select {
+		case changes := <-w.Changes:
+			if len(changes) != 1 ||
+				changes[0].Path != filepath.Join(dir, expected[name]) {
+				t.Fatalf("task %v unexpected changes %v", name, changes)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("task %v expected changes", name)
+		}
+	}
+
+	cancel()
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListTasks(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"web/a.js", "api/b.go", "api/c.md"} {
+		p := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(p, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in := NewCmdIn()
+	in.BaseDir = dir
+	in.SubCmd = CmdList
+	web := in.Task()
+	web.Name = "web"
+	web.WatchDirs = MultiFlag{"web"}
+	api := in.Task()
+	api.Name = "api"
+	api.WatchDirs = MultiFlag{"api"}
+	api.IncludeGlobs = MultiFlag{"**/*.go"}
+	in.Tasks = []*CmdIn{web, api}
+
+	var b bytes.Buffer
+	exitCode, err := in.runSubCmd(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCode != 0 {
+		t.Fatalf("exit code %v", exitCode)
+	}
+	expected := strings.Join([]string{
+		"[web]",
+		"dir " + filepath.Join(dir, "web"),
+		"file " + filepath.Join(dir, "web", "a.js"),
+		"",
+		"[api]",
+		"dir " + filepath.Join(dir, "api"),
+		"file " + filepath.Join(dir, "api", "b.go"),
+		"",
+	}, "\n")
+	if b.String() != expected {
+		t.Fatalf("list\n%v\nexpected\n%v", b.String(), expected)
+	}
+}
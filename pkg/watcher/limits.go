@@ -0,0 +1,70 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// InotifyDir contains the inotify limits on Linux
+const InotifyDir = "/proc/sys/fs/inotify"
+
+// InotifyLimit reads the inotify limit, e.g. max_user_watches.
+// Returns an error if the limit can't be read, e.g. on other platforms
+func InotifyLimit(name string) (int, error) {
+	b, err := os.ReadFile(filepath.Join(InotifyDir, name))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return limit, nil
+}
+
+// WatchLimitError is returned if the inotify watch limit is exhausted
+type WatchLimitError struct {
+	// Path that could not be watched
+	Path string
+	// Watches attempted by this process, including the failed one.
+	// Watches used by other processes also count towards the limit
+	Watches int
+	// Limit is the value of fs.inotify.max_user_watches,
+	// zero if it could not be read
+	Limit int
+	Err   error
+}
+
+func NewWatchLimitError(p string, watches int, err error) *WatchLimitError {
+	limit, _ := InotifyLimit("max_user_watches")
+	return &WatchLimitError{
+		Path:    p,
+		Watches: watches,
+		Limit:   limit,
+		Err:     err,
+	}
+}
+
+func (e *WatchLimitError) Error() string {
+	limit := "unknown"
+	if e.Limit > 0 {
+		limit = strconv.Itoa(e.Limit)
+	}
+	return fmt.Sprintf("inotify watch limit reached adding %v: "+
+		"%v watches attempted, fs.inotify.max_user_watches is %v; "+
+		"increase the limit with "+
+		"\"sudo sysctl fs.inotify.max_user_watches=524288\" "+
+		"(add it to /etc/sysctl.conf to persist), "+
+		"watch fewer dirs with -l, -excludeDir or -gitignore, "+
+		"or poll dirs that can't be watched with -pollFallback: %v",
+		e.Path, e.Watches, limit, e.Err)
+}
+
+func (e *WatchLimitError) Unwrap() error {
+	return e.Err
+}
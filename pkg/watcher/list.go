@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// List does a dry run of the walk done before watching,
+// and writes the dirs that would be watched, and the files that are included.
+// Notes are written if a root is excluded, and whether the limit
+// cut the walk short
+func (in *CmdIn) List(w io.Writer) (err error) {
+	for _, root := range in.Roots() {
+		excluded, err := in.DirExcluded(root, root)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if excluded {
+			fmt.Fprintf(w, "# %v is excluded\n", root)
+			continue
+		}
+
+		dirs, limited, err := in.listDirs(root)
+		if err != nil {
+			return err
+		}
+
+		for _, dir := range dirs {
+			fmt.Fprintf(w, "dir %v\n", dir)
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			for _, entry := range entries {
+				if entry.IsDir() {
+					continue
+				}
+				p := filepath.Join(dir, entry.Name())
+				included, err := in.FileIncluded(root, p)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if included {
+					fmt.Fprintf(w, "file %v\n", p)
+				}
+			}
+		}
+
+		if limited {
+			fmt.Fprintf(w, "# %v limit of %v sub dirs reached, "+
+				"the walk was cut short\n", root, in.Limit)
+		} else if in.Recursive {
+			fmt.Fprintf(w, "# %v %v sub dirs, limit of %v not reached\n",
+				root, len(dirs)-1, in.Limit)
+		}
+	}
+	return nil
+}
+
+// listDirs returns the root, and the sub dirs that would be watched
+// with the same walk as Tree.walk. Limited is set if the limit was reached
+func (in *CmdIn) listDirs(root string) (
+	dirs []string, limited bool, err error) {
+
+	dirs = []string{root}
+	if !in.Recursive {
+		return dirs, false, nil
+	}
+	err = in.WalkDirs(root, root, func(dir string) error {
+		if len(dirs)-1 >= in.Limit {
+			limited = true
+			return ErrLimit
+		}
+		dirs = append(dirs, dir)
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrLimit) {
+		return dirs, limited, errors.WithStack(err)
+	}
+	return dirs, limited, nil
+}
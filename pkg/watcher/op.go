@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// OpRescan is set for the synthetic change emitted for each root,
+// after the roots were rescanned because events were lost
+const OpRescan fsnotify.Op = 1 << 31
+
+// ops in the order they are listed in output
+var ops = []fsnotify.Op{
+	fsnotify.Create,
+	fsnotify.Write,
+	fsnotify.Remove,
+	fsnotify.Rename,
+	fsnotify.Chmod,
+}
+
+// allOps is the set of all ops
+const allOps = fsnotify.Create | fsnotify.Write | fsnotify.Remove |
+	fsnotify.Rename | fsnotify.Chmod
+
+// OpNames returns the lowercase names of the ops in the set
+func OpNames(op fsnotify.Op) []string {
+	names := make([]string, 0, len(ops))
+	for _, o := range ops {
+		if op.Has(o) {
+			names = append(names, strings.ToLower(o.String()))
+		}
+	}
+	if op.Has(OpRescan) {
+		names = append(names, "rescan")
+	}
+	return names
+}
+
+// ParseOps returns the set of ops for the names,
+// each name may also be a comma separated list, e.g. "write,create"
+func ParseOps(names []string) (op fsnotify.Op, err error) {
+	for _, name := range names {
+		for _, s := range strings.Split(name, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			found := false
+			for _, o := range ops {
+				if strings.EqualFold(s, o.String()) {
+					op |= o
+					found = true
+					break
+				}
+			}
+			if !found {
+				return op, errors.WithStack(fmt.Errorf("invalid op %v", s))
+			}
+		}
+	}
+	return op, nil
+}
+
+// OpMask returns the set of ops to include.
+// All ops are included by default
+func (in *CmdIn) OpMask() (mask fsnotify.Op, err error) {
+	mask = allOps
+	if len(in.Ops) > 0 {
+		mask, err = ParseOps(in.Ops)
+		if err != nil {
+			return mask, errors.WithStack(err)
+		}
+	}
+	ignore, err := ParseOps(in.IgnoreOps)
+	if err != nil {
+		return mask, errors.WithStack(err)
+	}
+	return mask &^ ignore, nil
+}
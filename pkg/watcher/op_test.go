@@ -0,0 +1,61 @@
+package watcher
+
+import (
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestParseOps(t *testing.T) {
+	tests := []struct {
+		names []string
+		op    fsnotify.Op
+		err   string
+	}{
+		{nil, 0, ""},
+		{[]string{"write"}, fsnotify.Write, ""},
+		{[]string{"write,create"}, fsnotify.Write | fsnotify.Create, ""},
+		{[]string{"write", "remove"}, fsnotify.Write | fsnotify.Remove, ""},
+		{[]string{" WRITE , Chmod ,"}, fsnotify.Write | fsnotify.Chmod, ""},
+		{[]string{"rename", "rename"}, fsnotify.Rename, ""},
+		{[]string{"write,foo"}, 0, "invalid op foo"},
+		{[]string{"rescan"}, 0, "invalid op rescan"},
+	}
+	for _, test := range tests {
+		op, err := ParseOps(test.names)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("ops %q error %v, expected %v",
+					test.names, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != test.op {
+			t.Errorf("ops %q parsed %v, expected %v", test.names, op, test.op)
+		}
+	}
+}
+
+func TestOpMask(t *testing.T) {
+	in := NewCmdIn()
+	mask, err := in.OpMask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask != allOps {
+		t.Fatalf("mask %v, expected all ops", mask)
+	}
+
+	in.Ops = MultiFlag{"write,create,chmod"}
+	in.IgnoreOps = MultiFlag{"chmod"}
+	mask, err = in.OpMask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask != fsnotify.Write|fsnotify.Create {
+		t.Fatalf("mask %v, expected write and create", mask)
+	}
+}
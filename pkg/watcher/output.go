@@ -0,0 +1,129 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const FormatText = "text"
+const FormatJSON = "json"
+
+// ChangeRecord is printed for each change in JSON Lines format
+type ChangeRecord struct {
+	// Path is the absolute path
+	Path string `json:"path"`
+	// RelPath is the slash separated path relative to the base dir,
+	// or the absolute path if it's not in the base dir
+	RelPath string `json:"relPath"`
+	// Ops seen for the path, e.g. create, write, remove, rename, chmod
+	Ops []string `json:"ops"`
+	// Root is the watched dir the path is in
+	Root string `json:"root"`
+	// Time of the last event for the path
+	Time time.Time `json:"time"`
+	// Task name, if tasks are defined
+	Task string `json:"task,omitempty"`
+}
+
+// Record for printing the change in JSON format
+func (in *CmdIn) Record(change Change) ChangeRecord {
+	return ChangeRecord{
+		Path:    change.Path,
+		RelPath: RelPath(in.BaseDir, change.Path),
+		Ops:     OpNames(change.Op),
+		Root:    change.Root,
+		Time:    change.Time,
+		Task:    in.Name,
+	}
+}
+
+// Print the changes to stdout.
+// Only the path to the last file that was modified is printed,
+// unless batch mode is enabled
+func (in *CmdIn) Print(changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if !in.Batch {
+		changes = changes[len(changes)-1:]
+	}
+	if in.Format == FormatJSON {
+		// One object per line
+		encoder := json.NewEncoder(os.Stdout)
+		for _, change := range changes {
+			err := encoder.Encode(in.Record(change))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Printf("%v%v\n", Prefix(in.Name), change.Path)
+	}
+	return nil
+}
+
+// Prefix returns the prefix for output lines of the task,
+// or an empty string if the name is not set
+func Prefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "[" + name + "] "
+}
+
+// prefixWriter writes each line with the prefix,
+// lines are written to the underlying writer once complete
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (pw *prefixWriter) Write(p []byte) (n int, err error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := make([]byte, 0, len(pw.prefix)+i+1)
+		line = append(line, pw.prefix...)
+		line = append(line, pw.buf[:i+1]...)
+		pw.buf = pw.buf[i+1:]
+		_, err = pw.w.Write(line)
+		if err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line if it doesn't end with a newline
+func (pw *prefixWriter) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	line := append(append([]byte{}, pw.prefix...), pw.buf...)
+	pw.buf = nil
+	_, err := pw.w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,40 @@
+package watcher
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// processGroupAlive returns true if any process in the group of p is running.
+// Zombies are ignored, in containers without an init process
+// orphans that exited may never be reaped
+func processGroupAlive(p *os.Process) bool {
+	if syscall.Kill(-p.Pid, 0) != nil {
+		return false
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return true
+	}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		b, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// Fields after the command name are: state ppid pgrp ...
+		stat := string(b)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+		if len(fields) < 3 || fields[0] == "Z" || fields[0] == "X" {
+			continue
+		}
+		if fields[2] == strconv.Itoa(p.Pid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package watcher
+
+import (
+	"os"
+	"syscall"
+)
+
+// processGroupAlive returns true if any process in the group of p exists
+func processGroupAlive(p *os.Process) bool {
+	return syscall.Kill(-p.Pid, 0) == nil
+}
@@ -0,0 +1,138 @@
+package watcher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Stage statuses in the pipeline summary
+const (
+	stageOK      = "ok"
+	stageError   = "error"
+	stageStopped = "stopped"
+	stageSkipped = "skipped"
+	stageStarted = "started"
+)
+
+// pipeline runs the stages in order, and then the command.
+// The first stage that fails skips the rest, and the command.
+// A summary with the overall status, and the status and duration
+// of each stage, is logged before waiting for the command to exit
+func (r *Runner) pipeline(ru *run, changes []Change) {
+	start := time.Now()
+	results := make([]string, 0, len(r.Stages)+1)
+	status := "passed"
+	for _, stage := range r.Stages {
+		if status != "passed" {
+			results = append(results, fmt.Sprintf("%v %v", stage, stageSkipped))
+			continue
+		}
+		stageStatus, elapsed := r.runStage(ru, stage, changes)
+		results = append(results,
+			fmt.Sprintf("%v %v %v", stage, stageStatus, elapsed))
+		switch stageStatus {
+		case stageOK:
+		case stageStopped:
+			status = "stopped"
+		default:
+			status = "failed"
+		}
+	}
+
+	var p *process
+	if r.Command != "" {
+		cmdStatus := stageSkipped
+		if status == "passed" {
+			p, cmdStatus = r.serve(ru, changes)
+			if cmdStatus == stageStopped {
+				status = "stopped"
+			}
+		}
+		results = append(results, fmt.Sprintf("%v %v", r.Command, cmdStatus))
+	}
+
+	e := log.Info()
+	if status == "failed" {
+		e = log.Warn()
+	}
+	r.event(e).Str("status", status).Strs("stages", results).
+		Dur("elapsed", time.Since(start).Round(time.Millisecond)).
+		Msg("Pipeline done")
+
+	if p != nil {
+		r.wait(p)
+	}
+}
+
+// runStage runs the stage to completion,
+// and returns the status and how long it took
+func (r *Runner) runStage(ru *run, stage string, changes []Change) (
+	status string, elapsed time.Duration) {
+
+	ru.mu.Lock()
+	if ru.stopped {
+		ru.mu.Unlock()
+		return stageStopped, 0
+	}
+	start := time.Now()
+	p, err := r.startProcess(stage, changes)
+	if err != nil {
+		ru.mu.Unlock()
+		r.event(log.Error()).Stack().Err(err).Str("stage", stage).
+			Msg("Start stage")
+		return stageError, 0
+	}
+	ru.proc = p
+	ru.mu.Unlock()
+
+	exitCode := r.wait(p)
+	elapsed = time.Since(start).Round(time.Millisecond)
+	if exitCode == 0 {
+		return stageOK, elapsed
+	}
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	if ru.stopped {
+		return stageStopped, elapsed
+	}
+	return fmt.Sprintf("failed (exit %v)", exitCode), elapsed
+}
+
+// serve starts the command after the stages passed.
+// With the restart policy, commands started by earlier runs are stopped first
+func (r *Runner) serve(ru *run, changes []Change) (p *process, status string) {
+	r.mu.Lock()
+	ru.mu.Lock()
+	ru.serving = true
+	ru.mu.Unlock()
+	var runs []*run
+	switch r.OnBusy {
+	case OnBusyQueue, OnBusySkip, OnBusyParallel:
+	default:
+		runs = r.remove(func(other *run) bool {
+			return other != ru && other.isServing()
+		})
+	}
+	r.mu.Unlock()
+	err := r.stopRuns(runs)
+	if err != nil {
+		r.event(log.Error()).Stack().Err(err).Str("cmd", r.Command).
+			Msg("Stop command")
+	}
+
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	if ru.stopped {
+		return nil, stageStopped
+	}
+	p, err = r.startProcess(r.Command, changes)
+	if err != nil {
+		r.event(log.Error()).Stack().Err(err).Str("cmd", r.Command).
+			Msg("Start command")
+		return nil, stageError
+	}
+	ru.proc = p
+	return p, stageStarted
+}
@@ -0,0 +1,217 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// DefaultPollInterval is used for polling as a fallback,
+// if the poll interval is not set
+const DefaultPollInterval = time.Second
+
+// fileState is compared between scans to detect changes
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// Poller periodically scans the roots for changes, for use on filesystems
+// where fsnotify does not receive events, e.g. NFS or Docker bind mounts.
+// Changes are sent on the events chan as fsnotify events
+type Poller struct {
+	in       *CmdIn
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+
+	mu sync.Mutex
+	// state per polled dir, maps each path to the state from the last scan
+	state map[string]map[string]fileState
+	// roots maps each polled dir to the watched root it's in
+	roots map[string]string
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewPoller(in *CmdIn, interval time.Duration,
+	events chan fsnotify.Event, errs chan error) *Poller {
+
+	return &Poller{
+		in:       in,
+		interval: interval,
+		events:   events,
+		errors:   errs,
+		state:    make(map[string]map[string]fileState),
+		roots:    make(map[string]string),
+		done:     make(chan struct{}),
+	}
+}
+
+// Add the dir to poll, changes are detected from the initial scan.
+// The dir is either a watched root,
+// or a sub dir in the root that can't be watched
+func (p *Poller) Add(root, dir string) error {
+	state, err := p.scan(root, dir)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state[dir] = state
+	p.roots[dir] = root
+	return nil
+}
+
+// Start polling in a new goroutine, until the poller is closed
+func (p *Poller) Start() {
+	go (func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				err := p.Poll()
+				if err != nil {
+					select {
+					case p.errors <- err:
+					case <-p.done:
+					}
+					return
+				}
+			}
+		}
+	})()
+}
+
+// Close stops polling
+func (p *Poller) Close() {
+	p.once.Do(func() {
+		close(p.done)
+	})
+}
+
+// Poll scans the roots once, and sends events for changes
+func (p *Poller) Poll() error {
+	p.mu.Lock()
+	dirs := make(map[string]string, len(p.roots))
+	for dir, root := range p.roots {
+		dirs[dir] = root
+	}
+	p.mu.Unlock()
+
+	for dir, root := range dirs {
+		state, err := p.scan(root, dir)
+		if err != nil {
+			_, statErr := os.Stat(dir)
+			if !os.IsNotExist(statErr) {
+				return err
+			}
+			// Removed, like with fsnotify this is not an error.
+			// Send remove events, and create events if it's created again
+			state = make(map[string]fileState)
+		}
+		p.mu.Lock()
+		prev := p.state[dir]
+		p.state[dir] = state
+		p.mu.Unlock()
+
+		for _, event := range diff(prev, state) {
+			select {
+			case p.events <- event:
+			case <-p.done:
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// diff returns the events to turn prev into next
+func diff(prev, next map[string]fileState) (events []fsnotify.Event) {
+	for name, n := range next {
+		pr, ok := prev[name]
+		if !ok {
+			events = append(events,
+				fsnotify.Event{Name: name, Op: fsnotify.Create})
+			continue
+		}
+		var op fsnotify.Op
+		if !n.mode.IsDir() &&
+			(!n.modTime.Equal(pr.modTime) || n.size != pr.size) {
+			op |= fsnotify.Write
+		}
+		if n.mode != pr.mode {
+			op |= fsnotify.Chmod
+		}
+		if op != 0 {
+			events = append(events, fsnotify.Event{Name: name, Op: op})
+		}
+	}
+	for name := range prev {
+		if _, ok := next[name]; !ok {
+			events = append(events,
+				fsnotify.Event{Name: name, Op: fsnotify.Remove})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Name < events[j].Name
+	})
+	return events
+}
+
+// scan the dir in the root, and the sub dirs if recursive,
+// with the same rules as for watching
+func (p *Poller) scan(root, dir string) (map[string]fileState, error) {
+	dirs := []string{dir}
+	if p.in.Recursive {
+		err := p.in.WalkDirs(root, dir, func(sub string) error {
+			if sub == dir {
+				return nil
+			}
+			if len(dirs) > p.in.Limit {
+				return ErrLimit
+			}
+			dirs = append(dirs, sub)
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrLimit) {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	state := make(map[string]fileState)
+	for _, d := range dirs {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			if (d != dir || dir != root) && os.IsNotExist(err) {
+				// Sub dir removed
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, errors.WithStack(err)
+			}
+			state[filepath.Join(d, entry.Name())] = fileState{
+				modTime: info.ModTime(),
+				size:    info.Size(),
+				mode:    info.Mode(),
+			}
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// signals that can be used to stop the command, by name without SIG prefix
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// setProcessGroup starts the command in a new process group,
+// so children of the shell can be signalled with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcessGroup signals all processes in the group of p.
+// No error is returned if the group already exited
+func signalProcessGroup(p *os.Process, sig syscall.Signal) error {
+	err := syscall.Kill(-p.Pid, sig)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
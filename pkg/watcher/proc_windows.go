@@ -0,0 +1,36 @@
+package watcher
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// signals are accepted for compatibility, the command is always killed
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+// setProcessGroup is not supported
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// signalProcessGroup kills p, signals are not supported
+func signalProcessGroup(p *os.Process, sig syscall.Signal) error {
+	err := p.Kill()
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// processGroupAlive is not supported, p is waited for instead
+func processGroupAlive(p *os.Process) bool {
+	return false
+}
@@ -0,0 +1,38 @@
+package watcher
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// fsTypes maps filesystem magic numbers to names, see statfs(2)
+var fsTypes = map[uint32]string{
+	0x0000EF53: "ext4",
+	0x01021994: "tmpfs",
+	0x01021997: "9p",
+	0x2FC12FC1: "zfs",
+	0x58465342: "xfs",
+	0x6969:     "nfs",
+	0x65735546: "fuse",
+	0x786F4256: "vboxsf",
+	0x794C7630: "overlayfs",
+	0x9123683E: "btrfs",
+	0xFE534D42: "smb2",
+	0xFF534D42: "cifs",
+}
+
+// FSType returns the name of the filesystem type for the path
+func FSType(p string) (string, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(p, &st)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	name, ok := fsTypes[uint32(st.Type)]
+	if !ok {
+		return fmt.Sprintf("0x%x", uint32(st.Type)), nil
+	}
+	return name, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package watcher
+
+// FSType returns the name of the filesystem type for the path,
+// only supported on Linux
+func FSType(p string) (string, error) {
+	return "unknown", nil
+}
@@ -0,0 +1,84 @@
+package watcher
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Placeholders in the command are replaced with values from the last change,
+// or all changes for {paths}. Values are quoted for the shell
+const (
+	// PlaceholderPath is the absolute path
+	PlaceholderPath = "{path}"
+	// PlaceholderRelPath is the slash separated path relative to the base dir,
+	// or the absolute path if it's not in the base dir
+	PlaceholderRelPath = "{relpath}"
+	// PlaceholderOp is the comma separated ops, e.g. create,write
+	PlaceholderOp = "{op}"
+	// PlaceholderDir is the dir the path is in
+	PlaceholderDir = "{dir}"
+	// PlaceholderPaths is the space separated paths in the batch
+	PlaceholderPaths = "{paths}"
+)
+
+// Env vars are set for the command, values are empty on start
+const (
+	EnvPath  = "WATCHER_PATH"
+	EnvOp    = "WATCHER_OP"
+	EnvPaths = "WATCHER_PATHS"
+	EnvRoot  = "WATCHER_ROOT"
+)
+
+// ShellQuote quotes s as a single word for sh
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ExpandCommand replaces the placeholders in the command
+// with values from the changes
+func ExpandCommand(command, baseDir string, changes []Change) string {
+	if !strings.Contains(command, "{") {
+		return command
+	}
+	var last Change
+	if len(changes) > 0 {
+		last = changes[len(changes)-1]
+	}
+	paths := make([]string, 0, len(changes))
+	for _, change := range changes {
+		paths = append(paths, ShellQuote(change.Path))
+	}
+	dir := ""
+	if last.Path != "" {
+		dir = filepath.Dir(last.Path)
+	}
+	relpath := ""
+	if last.Path != "" {
+		relpath = RelPath(baseDir, last.Path)
+	}
+	return strings.NewReplacer(
+		PlaceholderPath, ShellQuote(last.Path),
+		PlaceholderRelPath, ShellQuote(relpath),
+		PlaceholderOp, ShellQuote(strings.Join(OpNames(last.Op), ",")),
+		PlaceholderDir, ShellQuote(dir),
+		PlaceholderPaths, strings.Join(paths, " "),
+	).Replace(command)
+}
+
+// CommandEnv returns the env vars describing the changes
+func CommandEnv(changes []Change) []string {
+	var last Change
+	if len(changes) > 0 {
+		last = changes[len(changes)-1]
+	}
+	paths := make([]string, 0, len(changes))
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+	return []string{
+		EnvPath + "=" + last.Path,
+		EnvOp + "=" + strings.Join(OpNames(last.Op), ","),
+		EnvPaths + "=" + strings.Join(paths, "\n"),
+		EnvRoot + "=" + last.Root,
+	}
+}
@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestExpandCommand(t *testing.T) {
+	changes := []Change{
+		{Path: "/src/a.go", Op: fsnotify.Write, Root: "/src"},
+		{Path: "/src/it's dir/b c.go", Op: fsnotify.Create | fsnotify.Write,
+			Root: "/src"},
+	}
+	tests := []struct {
+		command  string
+		changes  []Change
+		expanded string
+	}{
+		{"go test", changes, "go test"},
+		{"echo {path}", changes, `echo '/src/it'\''s dir/b c.go'`},
+		{"echo {relpath}", changes, `echo 'it'\''s dir/b c.go'`},
+		{"echo {op}", changes, "echo 'create,write'"},
+		{"echo {dir}", changes, `echo '/src/it'\''s dir'`},
+		{"gofmt -l {paths}", changes,
+			`gofmt -l '/src/a.go' '/src/it'\''s dir/b c.go'`},
+		// Outside the base dir
+		{"echo {relpath}", []Change{{Path: "/tmp/a.go"}}, "echo '/tmp/a.go'"},
+		// Empty on start
+		{"echo {path} {relpath} {op} {dir}", nil, "echo '' '' '' ''"},
+		{"echo {paths}", nil, "echo "},
+	}
+	for _, test := range tests {
+		expanded := ExpandCommand(test.command, "/src", test.changes)
+		if expanded != test.expanded {
+			t.Errorf("command %q expanded %q, expected %q",
+				test.command, expanded, test.expanded)
+		}
+	}
+
+	// Quoted values are single words for the shell
+	out, err := exec.Command("sh", "-c",
+		ExpandCommand("printf '%s|' {paths}", "/src", changes)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "/src/a.go|/src/it's dir/b c.go|" {
+		t.Fatalf("unexpected words %q", out)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	tests := []struct {
+		changes []Change
+		env     []string
+	}{
+		{[]Change{
+			{Path: "/src/a.go", Op: fsnotify.Write, Root: "/src"},
+			{Path: "/src/b.go", Op: fsnotify.Remove, Root: "/src"},
+		}, []string{
+			"WATCHER_PATH=/src/b.go",
+			"WATCHER_OP=remove",
+			"WATCHER_PATHS=/src/a.go\n/src/b.go",
+			"WATCHER_ROOT=/src",
+		}},
+		// Empty on start
+		{nil, []string{
+			"WATCHER_PATH=",
+			"WATCHER_OP=",
+			"WATCHER_PATHS=",
+			"WATCHER_ROOT=",
+		}},
+	}
+	for _, test := range tests {
+		env := CommandEnv(test.changes)
+		if strings.Join(env, "|") != strings.Join(test.env, "|") {
+			t.Errorf("env %q, expected %q", env, test.env)
+		}
+	}
+}
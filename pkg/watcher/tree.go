@@ -0,0 +1,411 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrLimit is returned to stop walking when the limit is reached
+var ErrLimit = errors.New("limit reached")
+
+// WalkDirs calls fn for p, and each dir below p, that must be watched.
+// The root itself, hidden dirs and excluded dirs are skipped.
+// Return ErrLimit from fn to stop walking
+func (in *CmdIn) WalkDirs(root, p string, fn func(dir string) error) error {
+	return filepath.Walk(p,
+		func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				if p != root && os.IsNotExist(err) {
+					// Removed while walking
+					return nil
+				}
+				return errors.WithStack(err)
+			}
+			// Don't include path twice
+			if p == root || !info.IsDir() {
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), ".") {
+				// Skip hidden dirs
+				return filepath.SkipDir
+			}
+			// Check dir exclusion filter
+			excluded, err := in.DirExcluded(root, p)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if excluded {
+				// Skip excluded dirs
+				return filepath.SkipDir
+			}
+			return fn(p)
+		})
+}
+
+// DirWatcher adds and removes dirs to watch, e.g. fsnotify.Watcher
+type DirWatcher interface {
+	Add(name string) error
+	Remove(name string) error
+}
+
+// Tree keeps track of the dirs added to the watcher,
+// so dirs created or removed after startup can be watched or dropped.
+// Roots are polled instead if the poller is set,
+// and the watcher is not set or fails.
+// Dirs must be added and removed by one goroutine at a time.
+// The lock is not held while calling the watcher, so Root and Watched
+// don't block on it, e.g. on Windows fsnotify Add waits for the goroutine
+// that sends events
+type Tree struct {
+	in      *CmdIn
+	watcher DirWatcher
+	poller  *Poller
+
+	mu sync.Mutex
+	// roots maps each watched root dir to the number of sub dirs added
+	roots map[string]int
+	// dirs maps each watched dir to its root
+	dirs map[string]string
+	// limited is set once the watch limit was reached
+	limited bool
+}
+
+func NewTree(in *CmdIn, watcher DirWatcher, poller *Poller) *Tree {
+	return &Tree{
+		in:      in,
+		watcher: watcher,
+		poller:  poller,
+		roots:   make(map[string]int),
+		dirs:    make(map[string]string),
+	}
+}
+
+// AddRoot watches the root dir, and sub dirs if recursive
+func (t *Tree) AddRoot(root string) error {
+	// Check dir exclusion filter
+	excluded, err := t.in.DirExcluded(root, root)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if excluded {
+		return nil
+	}
+
+	if t.watcher == nil || (t.poller != nil && !t.in.PollFallback) {
+		return t.poll(root)
+	}
+
+	err = t.addRoot(root)
+	var limitErr *WatchLimitError
+	if errors.Is(err, syscall.ENOSPC) && !errors.As(err, &limitErr) {
+		// Adding the root failed, sub dirs return a limit error from walk
+		t.mu.Lock()
+		watches := len(t.dirs) + 1
+		t.mu.Unlock()
+		err = errors.WithStack(NewWatchLimitError(root, watches, err))
+	}
+	if err != nil && t.poller != nil {
+		log.Warn().Err(err).Str("path", root).
+			Msg("Watch failed, falling back to polling")
+		t.removeRoot(root)
+		return t.poll(root)
+	}
+	return err
+}
+
+func (t *Tree) addRoot(root string) error {
+	// Watch the specified dir
+	log.Debug().Str("path", root).Msg("Add path")
+	err := t.watcher.Add(root)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	t.mu.Lock()
+	if _, ok := t.roots[root]; !ok {
+		t.roots[root] = 0
+	}
+	t.dirs[root] = root
+	t.mu.Unlock()
+
+	// Watch sub dirs recursively
+	if t.in.Recursive {
+		return t.walk(root, root, true)
+	}
+	return nil
+}
+
+// poll the root instead of watching it
+func (t *Tree) poll(root string) error {
+	t.mu.Lock()
+	if _, ok := t.roots[root]; !ok {
+		t.roots[root] = 0
+	}
+	t.mu.Unlock()
+
+	log.Debug().Str("path", root).Msg("Poll path")
+	return t.poller.Add(root, root)
+}
+
+// AddDir watches a dir created after startup, and the sub dirs it contains.
+// The dir is only added if the parent dir is watched,
+// and the same rules apply as for the initial walk
+func (t *Tree) AddDir(p string) error {
+	t.mu.Lock()
+	_, watched := t.dirs[p]
+	root, ok := t.dirs[filepath.Dir(p)]
+	t.mu.Unlock()
+
+	if watched || !ok {
+		// Already watched, or the parent dir is not watched
+		return nil
+	}
+	return t.walk(root, p, false)
+}
+
+// walk adds p and the sub dirs to watch, until the root limit is reached.
+// Errors are returned if strict, for the initial walk. Otherwise dirs that
+// can't be watched are logged and skipped, e.g. a temp dir that was removed
+// again, or a dir created by another user without read permission.
+// Must be called without the lock held
+func (t *Tree) walk(root, p string, strict bool) error {
+	err := t.in.WalkDirs(root, p, func(p string) error {
+		t.mu.Lock()
+		_, watched := t.dirs[p]
+		limit := t.roots[root] >= t.in.Limit
+		watches := len(t.dirs) + 1
+		t.mu.Unlock()
+		if watched {
+			return nil
+		}
+		if limit {
+			return ErrLimit
+		}
+		// Watch sub dir
+		log.Debug().Str("path", p).Msg("Add sub path")
+		err := t.watcher.Add(p)
+		if errors.Is(err, syscall.ENOSPC) {
+			limitErr := NewWatchLimitError(p, watches, err)
+			if t.poller == nil {
+				if strict {
+					return errors.WithStack(limitErr)
+				}
+				return skipDir(p, limitErr)
+			}
+			// Poll the dirs that can't be watched
+			logEvent := log.Debug()
+			t.mu.Lock()
+			if !t.limited {
+				// Only warn once
+				t.limited = true
+				logEvent = log.Warn()
+			}
+			t.mu.Unlock()
+			logEvent.Str("path", p).Int("watches", limitErr.Watches).
+				Int("limit", limitErr.Limit).
+				Msg("Watch limit reached, falling back to polling")
+			err = t.poller.Add(root, p)
+			if err != nil {
+				if strict {
+					return err
+				}
+				return skipDir(p, err)
+			}
+			return filepath.SkipDir
+		}
+		if err != nil {
+			if strict {
+				return errors.WithStack(err)
+			}
+			return skipDir(p, err)
+		}
+		t.mu.Lock()
+		t.dirs[p] = root
+		t.roots[root]++
+		t.mu.Unlock()
+		return nil
+	})
+	if errors.Is(err, ErrLimit) {
+		log.Debug().Str("path", root).Int("limit", t.in.Limit).
+			Msg("Limit reached")
+		return nil
+	}
+	if err != nil && !strict {
+		log.Warn().Err(err).Str("path", p).Msg("Walk failed")
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// skipDir logs why the dir can't be watched, and skips it and its sub dirs
+func skipDir(p string, err error) error {
+	log.Warn().Err(err).Str("path", p).Msg("Watch failed, skipping dir")
+	return filepath.SkipDir
+}
+
+// Remove drops the watches for p and the dirs below it,
+// e.g. after the dir was removed or renamed
+func (t *Tree) Remove(p string) {
+	t.mu.Lock()
+	if _, ok := t.dirs[p]; !ok {
+		t.mu.Unlock()
+		return
+	}
+	var removed []string
+	prefix := p + string(filepath.Separator)
+	for dir, root := range t.dirs {
+		if dir != p && !strings.HasPrefix(dir, prefix) {
+			continue
+		}
+		if dir == root {
+			// Root dirs stay in the list,
+			// the watch is removed automatically if the dir is gone
+			continue
+		}
+		delete(t.dirs, dir)
+		t.roots[root]--
+		removed = append(removed, dir)
+	}
+	t.mu.Unlock()
+
+	t.unwatch(removed)
+}
+
+// unwatch removes the dirs from the watcher,
+// must be called without the lock held
+func (t *Tree) unwatch(dirs []string) {
+	for _, dir := range dirs {
+		log.Debug().Str("path", dir).Msg("Remove sub path")
+		// Removed dirs are no longer watched by the OS,
+		// ignore the error in that case
+		_ = t.watcher.Remove(dir)
+	}
+}
+
+// removeRoot drops the watches for the root and all its sub dirs
+func (t *Tree) removeRoot(root string) {
+	t.mu.Lock()
+	var removed []string
+	for dir, r := range t.dirs {
+		if r == root {
+			delete(t.dirs, dir)
+			removed = append(removed, dir)
+		}
+	}
+	delete(t.roots, root)
+	t.mu.Unlock()
+
+	t.unwatch(removed)
+}
+
+// Roots returns the watched root dirs
+func (t *Tree) Roots() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	roots := make([]string, 0, len(t.roots))
+	for root := range t.roots {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// Rescan walks the watched roots again after events were lost,
+// to watch dirs that were created, and drop dirs that were removed
+func (t *Tree) Rescan() error {
+	t.mu.Lock()
+	var removed, roots []string
+	for dir, root := range t.dirs {
+		if dir == root {
+			roots = append(roots, root)
+			continue
+		}
+		_, err := os.Stat(dir)
+		if err != nil && os.IsNotExist(err) {
+			delete(t.dirs, dir)
+			t.roots[root]--
+			removed = append(removed, dir)
+		}
+	}
+	t.mu.Unlock()
+
+	t.unwatch(removed)
+	if !t.in.Recursive {
+		return nil
+	}
+	sort.Strings(roots)
+	for _, root := range roots {
+		err := t.walk(root, root, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Root returns the watched root dir for p,
+// or an empty string if p is not in a watched dir
+func (t *Tree) Root(p string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if root, ok := t.dirs[p]; ok {
+		return root
+	}
+	if root, ok := t.dirs[filepath.Dir(p)]; ok {
+		return root
+	}
+	// Longest matching root,
+	// e.g. for polled roots, or dirs that were removed from the tree
+	var match string
+	for root := range t.roots {
+		if len(root) > len(match) &&
+			(p == root || strings.HasPrefix(p, root+string(filepath.Separator))) {
+			match = root
+		}
+	}
+	return match
+}
+
+// Watched returns true if p is a watched dir, or in a watched dir
+func (t *Tree) Watched(p string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.dirs[p]; ok {
+		return true
+	}
+	_, ok := t.dirs[filepath.Dir(p)]
+	return ok
+}
+
+// Event updates the tree for dirs created, removed or renamed
+func (t *Tree) Event(event fsnotify.Event) error {
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		t.Remove(event.Name)
+		return nil
+	}
+	if !t.in.Recursive || !event.Has(fsnotify.Create) {
+		return nil
+	}
+	info, err := os.Stat(event.Name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Already removed
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	return t.AddDir(event.Name)
+}
@@ -0,0 +1,219 @@
+package watcher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// limitWatcher records the watched dirs,
+// and fails with ENOSPC once n dirs were added, unless n is negative
+type limitWatcher struct {
+	n       int
+	watched map[string]bool
+}
+
+func (l *limitWatcher) Add(name string) error {
+	if l.n == 0 {
+		return syscall.ENOSPC
+	}
+	if l.n > 0 {
+		l.n--
+	}
+	if l.watched == nil {
+		l.watched = make(map[string]bool)
+	}
+	l.watched[name] = true
+	return nil
+}
+
+func (l *limitWatcher) Remove(name string) error {
+	delete(l.watched, name)
+	return nil
+}
+
+func TestTreeWatchLimit(t *testing.T) {
+	dir := t.TempDir()
+	err := os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := NewCmdIn()
+	in.Recursive = true
+	err = in.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		n    int
+		path string
+	}{
+		{0, dir},
+		{1, filepath.Join(dir, "sub")},
+	} {
+		tree := NewTree(in, &limitWatcher{n: test.n}, nil)
+		err = tree.AddRoot(dir)
+		var limitErr *WatchLimitError
+		if !errors.As(err, &limitErr) {
+			t.Fatalf("expected limit error, got %v", err)
+		}
+		// Not wrapped twice
+		if limitErr.Path != test.path ||
+			strings.Count(err.Error(), "watch limit reached") != 1 {
+			t.Fatalf("unexpected error for %v: %v", test.path, err)
+		}
+	}
+}
+
+func TestTreeAddDirError(t *testing.T) {
+	dir := t.TempDir()
+	in := NewCmdIn()
+	in.Recursive = true
+	err := in.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := NewTree(in, &limitWatcher{n: 1}, nil)
+	err = tree.AddRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dirs created after startup that can't be watched are skipped
+	sub := filepath.Join(dir, "sub")
+	err = os.MkdirAll(filepath.Join(sub, "nested"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.AddDir(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tree.dirs[sub]; ok {
+		t.Fatal("expected sub dir to be skipped")
+	}
+	if tree.roots[dir] != 0 {
+		t.Fatalf("sub dirs %v, expected 0", tree.roots[dir])
+	}
+}
+
+// assertTree checks the dirs in the tree and the watcher,
+// relative to the root, and the number of sub dirs counted for the limit
+func assertTree(t *testing.T, tree *Tree, l *limitWatcher, root string,
+	expected []string) {
+
+	t.Helper()
+	var dirs, watched []string
+	for dir := range tree.dirs {
+		dirs = append(dirs, RelPath(root, dir))
+	}
+	for dir := range l.watched {
+		watched = append(watched, RelPath(root, dir))
+	}
+	sort.Strings(dirs)
+	sort.Strings(watched)
+	if strings.Join(dirs, " ") != strings.Join(expected, " ") ||
+		strings.Join(watched, " ") != strings.Join(expected, " ") {
+		t.Fatalf("tree %v watched %v, expected %v", dirs, watched, expected)
+	}
+	if tree.roots[root] != len(expected)-1 {
+		t.Fatalf("sub dirs %v, expected %v",
+			tree.roots[root], len(expected)-1)
+	}
+}
+
+func TestTreeAddRemove(t *testing.T) {
+	root := t.TempDir()
+	mkdir := func(name string) string {
+		t.Helper()
+		p := filepath.Join(root, name)
+		err := os.MkdirAll(p, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	mkdir("a")
+
+	in := NewCmdIn()
+	in.Recursive = true
+	in.Limit = 3
+	in.ExcludeDirGlobs = MultiFlag{"**/skip"}
+	err := in.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &limitWatcher{n: -1}
+	tree := NewTree(in, l, nil)
+	err = tree.AddRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tree, l, root, []string{".", "a"})
+
+	// Dirs created after startup, nested dirs are added in one walk,
+	// hidden and excluded dirs are skipped
+	for _, name := range []string{"b/c", ".hidden", "skip"} {
+		mkdir(name)
+		name = strings.Split(name, "/")[0]
+		err = tree.Event(fsnotify.Event{
+			Name: filepath.Join(root, name), Op: fsnotify.Create})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tree.Event(fsnotify.Event{Name: mkdir("a/skip"), Op: fsnotify.Create})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tree, l, root, []string{".", "a", "b", "b/c"})
+	if !tree.Watched(filepath.Join(root, "b", "c", "x.go")) ||
+		tree.Watched(filepath.Join(root, "skip", "x.go")) {
+		t.Fatal("unexpected watched paths")
+	}
+
+	// The limit of 3 sub dirs is reached
+	e := mkdir("e")
+	err = tree.Event(fsnotify.Event{Name: e, Op: fsnotify.Create})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tree, l, root, []string{".", "a", "b", "b/c"})
+
+	// Renamed away, the watches are dropped and the count drops
+	b := filepath.Join(root, "b")
+	err = os.Rename(b, filepath.Join(t.TempDir(), "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.Event(fsnotify.Event{Name: b, Op: fsnotify.Rename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tree, l, root, []string{".", "a"})
+
+	// Below the limit again
+	err = tree.Event(fsnotify.Event{Name: e, Op: fsnotify.Create})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tree, l, root, []string{".", "a", "e"})
+
+	// Removed
+	err = os.Remove(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.Event(fsnotify.Event{Name: e, Op: fsnotify.Remove})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tree, l, root, []string{".", "a"})
+}
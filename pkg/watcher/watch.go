@@ -0,0 +1,550 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrStop may be returned from OnChange to stop Run without an error
+var ErrStop = errors.New("stop")
+
+// ErrTimeout is returned from Run if nothing changed within the timeout
+var ErrTimeout = errors.New("timeout")
+
+// Watcher watches the dirs specified by the options,
+// and delivers the changes in batches after the delay.
+// Use New to create a watcher, then Run it
+type Watcher struct {
+	// Changes receives the batch of changes after each delay,
+	// unless OnChange is set. The chan is closed when Run returns
+	Changes chan []Change
+	// OnChange is called with the batch of changes after each delay.
+	// Returning an error stops Run
+	OnChange func(changes []Change) error
+
+	in *CmdIn
+	// fs is not set if the watcher could not be created,
+	// and polling is used instead
+	fs     *fsnotify.Watcher
+	poller *Poller
+	tree   *Tree
+	// events from the watcher and the poller
+	events chan fsnotify.Event
+	// shared events from a watcher shared with other tasks,
+	// only events for dirs in the tree are included
+	shared chan fsnotify.Event
+	// errors from the watcher, poller and callbacks
+	errors chan error
+	// rescans is signalled if events were lost
+	rescans chan bool
+	// updates to the tree, applied in order by another goroutine,
+	// so reading events is not blocked while dirs are added
+	updatesMu sync.Mutex
+	updates   []fsnotify.Event
+	// updated is signalled when updates are queued
+	updated chan bool
+	done    chan struct{}
+	// wg waits for callbacks before closing the changes chan
+	wg sync.WaitGroup
+}
+
+// New creates a watcher and adds the dirs to watch,
+// changes are delivered once Run is called
+func New(in *CmdIn) (w *Watcher, err error) {
+	w, err = newWatcher(in)
+	if err != nil {
+		return w, err
+	}
+
+	if in.Poll == 0 || in.PollFallback {
+		w.fs, err = fsnotify.NewWatcher()
+		if err != nil {
+			if !in.PollFallback {
+				return w, errors.WithStack(err)
+			}
+			log.Warn().Err(err).Msg("Watcher failed, falling back to polling")
+		} else {
+			go w.forward()
+		}
+	}
+
+	var dirs DirWatcher
+	if w.fs != nil {
+		dirs = w.fs
+	}
+	err = w.watch(dirs)
+	if err != nil {
+		_ = w.Close()
+		return w, err
+	}
+	return w, nil
+}
+
+// newWatcher validates the options, and returns a watcher without dirs
+func newWatcher(in *CmdIn) (w *Watcher, err error) {
+	err = in.prepare()
+	if err != nil {
+		return w, err
+	}
+
+	return &Watcher{
+		Changes: make(chan []Change),
+		in:      in,
+		events:  make(chan fsnotify.Event),
+		errors:  make(chan error),
+		rescans: make(chan bool, 1),
+		updated: make(chan bool, 1),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// prepare defaults the base dir to the working dir, and prepares the options
+func (in *CmdIn) prepare() (err error) {
+	if in.BaseDir == "" {
+		in.BaseDir, err = os.Getwd()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	err = in.Prepare()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// watch adds the roots to the dir watcher, and sets up polling if required.
+// Roots are polled if the dir watcher is nil
+func (w *Watcher) watch(dirs DirWatcher) error {
+	in := w.in
+	if in.Poll > 0 || in.PollFallback {
+		interval := in.Poll
+		if interval == 0 {
+			interval = DefaultPollInterval
+		}
+		w.poller = NewPoller(in, interval, w.events, w.errors)
+	}
+
+	w.tree = NewTree(in, dirs, w.poller)
+
+	for _, root := range in.Roots() {
+		err := w.tree.AddRoot(root)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Roots returns the absolute paths of the dirs to watch
+func (in *CmdIn) Roots() []string {
+	roots := make([]string, 0, len(in.WatchDirs))
+	for _, relativePath := range in.WatchDirs {
+		// Use absolute paths
+		if filepath.IsAbs(relativePath) {
+			roots = append(roots, relativePath)
+		} else {
+			// Prefix basedir
+			roots = append(roots, path.Join(in.BaseDir, relativePath))
+		}
+	}
+	return roots
+}
+
+// forward events and errors from the watcher
+func (w *Watcher) forward() {
+	for {
+		select {
+		case event, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			select {
+			case w.events <- event:
+			case <-w.done:
+				return
+			}
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Recoverable, rescan unless a rescan is already pending
+				select {
+				case w.rescans <- true:
+				default:
+				}
+				continue
+			}
+			w.error(err)
+		}
+	}
+}
+
+// error is returned from Run, unless Run already returned
+func (w *Watcher) error(err error) {
+	select {
+	case w.errors <- err:
+	case <-w.done:
+	}
+}
+
+// Close the watcher and stop polling,
+// this is done automatically when Run returns
+func (w *Watcher) Close() error {
+	select {
+	case <-w.done:
+		return nil
+	default:
+		close(w.done)
+	}
+	if w.poller != nil {
+		w.poller.Close()
+	}
+	if w.fs != nil {
+		return errors.WithStack(w.fs.Close())
+	}
+	return nil
+}
+
+// change delivers the batch of changes
+func (w *Watcher) change(changes []Change) error {
+	if w.OnChange != nil {
+		return w.OnChange(changes)
+	}
+	select {
+	case w.Changes <- changes:
+	case <-w.done:
+	}
+	return nil
+}
+
+// include returns true if the event must be included in the batch,
+// and updates the tree for dirs created or removed
+func (w *Watcher) include(event *fsnotify.Event, mask fsnotify.Op) (
+	root string, included bool, err error) {
+
+	in := w.in
+	// Reload rules if an ignore file changed
+	if in.ignore != nil {
+		for _, name := range IgnoreFiles {
+			if filepath.Base(event.Name) == name {
+				in.ignore.Reset(filepath.Dir(event.Name))
+			}
+		}
+	}
+
+	// Watch new dirs, and drop removed dirs
+	w.update(*event)
+
+	// Filtered ops must not reset the timer
+	op := event.Op & mask
+	if op == 0 {
+		log.Debug().
+			Str("op", event.Op.String()).
+			Str("name", event.Name).
+			Msg("Excluded op")
+		return root, false, nil
+	}
+	event.Op = op
+
+	// Check if file must be included
+	root = w.tree.Root(event.Name)
+	included, err = in.FileIncluded(root, event.Name)
+	if err != nil {
+		return root, false, errors.WithStack(err)
+	}
+	if included {
+		log.Debug().
+			Str("op", event.Op.String()).
+			Str("name", event.Name).
+			Msg("Included")
+	}
+	return root, included, nil
+}
+
+// update queues the event to update the tree with.
+// The queue is not bounded, so the caller never blocks
+func (w *Watcher) update(event fsnotify.Event) {
+	if !event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) &&
+		!event.Has(fsnotify.Create) && !event.Has(OpRescan) {
+		return
+	}
+	w.updatesMu.Lock()
+	w.updates = append(w.updates, event)
+	w.updatesMu.Unlock()
+	select {
+	case w.updated <- true:
+	default:
+	}
+}
+
+// updateTree applies the queued updates to the tree, in order.
+// Runs in its own goroutine, on Windows fsnotify Add waits for the
+// goroutine that sends events, and would deadlock if called from Run.
+// Dirs that can't be watched don't stop the watcher
+func (w *Watcher) updateTree() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.updated:
+		}
+		w.updatesMu.Lock()
+		updates := w.updates
+		w.updates = nil
+		w.updatesMu.Unlock()
+
+		for _, event := range updates {
+			var err error
+			if event.Has(OpRescan) {
+				// Events were lost, watch dirs created in the meantime
+				err = w.tree.Rescan()
+			} else {
+				err = w.tree.Event(event)
+			}
+			if err != nil {
+				log.Warn().Err(err).Str("path", event.Name).
+					Msg("Watch failed")
+			}
+		}
+	}
+}
+
+// deliver batches of changes from the deliveries chan, one at a time,
+// and signal on the delivered chan when done
+func (w *Watcher) deliver(deliveries chan []Change, delivered chan bool) {
+	defer w.wg.Done()
+	for changes := range deliveries {
+		err := w.change(changes)
+		if err != nil {
+			w.error(err)
+		} else if w.in.Once {
+			// Stop after the first change
+			w.error(ErrStop)
+		}
+		select {
+		case delivered <- true:
+		case <-w.done:
+		}
+	}
+}
+
+// newStoppedTimer returns a timer that must be reset to start
+func newStoppedTimer() *time.Timer {
+	timer := time.NewTimer(time.Hour)
+	stopTimer(timer)
+	return timer
+}
+
+// stopTimer stops the timer, and drains the chan if the timer fired
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// Run the watch loop until the context is done, or an error occurs.
+// The context error is not returned.
+// In debounce mode a single timer is reset by each included event,
+// the batch is delivered when the timer fires,
+// or when the max wait passed since the first event in the batch.
+// In leading mode the first change is delivered immediately,
+// and changes are ignored until the delay passed.
+// In throttle mode changes are delivered at most once per delay.
+// Changes that arrive while the previous batch is being delivered
+// are delivered in the next batch
+func (w *Watcher) Run(ctx context.Context) (err error) {
+	in := w.in
+	delay := time.Duration(in.Delay) * time.Millisecond
+
+	deliveries := make(chan []Change)
+	delivered := make(chan bool)
+	w.wg.Add(2)
+	go w.deliver(deliveries, delivered)
+	go w.updateTree()
+
+	// The timer is only reset by included events
+	timer := newStoppedTimer()
+	// The max timer is started by the first event in the batch
+	maxTimer := newStoppedTimer()
+	maxWait := time.Duration(in.MaxWait) * time.Millisecond
+	defer (func() {
+		timer.Stop()
+		maxTimer.Stop()
+		closeErr := w.Close()
+		close(deliveries)
+		w.wg.Wait()
+		close(w.Changes)
+		if err == nil {
+			err = closeErr
+		}
+	})()
+
+	if w.poller != nil {
+		w.poller.Start()
+	}
+
+	batch := &Batch{}
+	mask, err := in.OpMask()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Timeout if nothing changed
+	var timeout <-chan time.Time
+	if in.Timeout > 0 {
+		timeoutTimer := time.NewTimer(in.Timeout)
+		defer timeoutTimer.Stop()
+		timeout = timeoutTimer.C
+	}
+
+	// fire is set while the timer is running
+	var fire <-chan time.Time
+	// maxFire is set while the max timer is running
+	var maxFire <-chan time.Time
+	// ready is set if the delay passed while delivering the previous batch
+	ready := false
+	// due is set if the max wait passed while delivering the previous batch
+	due := false
+	busy := false
+	flush := func() {
+		ready = false
+		due = false
+		stopTimer(maxTimer)
+		maxFire = nil
+		changes := batch.Flush()
+		if len(changes) == 0 {
+			return
+		}
+		busy = true
+		deliveries <- changes
+	}
+
+	// add the event to the batch, and schedule delivery for the mode
+	add := func(event fsnotify.Event, root string) {
+		if in.Mode == ModeLeading && fire != nil {
+			log.Debug().Str("name", event.Name).Msg("Ignored in window")
+			return
+		}
+		batch.Add(event, root)
+		// A change is pending
+		timeout = nil
+		ready = due
+
+		switch in.Mode {
+		case ModeLeading:
+			// Deliver now, and ignore changes until the timer fires
+			timer.Reset(delay)
+			fire = timer.C
+			if busy {
+				ready = true
+			} else {
+				flush()
+			}
+			return
+		case ModeThrottle:
+			// Deliver when the timer fires, the timer is not reset
+			if fire == nil {
+				timer.Reset(delay)
+				fire = timer.C
+			}
+		default:
+			// Reset the timer in case multiple files are changed
+			stopTimer(timer)
+			timer.Reset(delay)
+			fire = timer.C
+		}
+		// Cap the delay for the first event in the batch
+		if maxWait > 0 && maxFire == nil && !due {
+			maxTimer.Reset(maxWait)
+			maxFire = maxTimer.C
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-timeout:
+			return errors.WithStack(ErrTimeout)
+
+		case err := <-w.errors:
+			if errors.Is(err, ErrStop) {
+				return nil
+			}
+			return errors.WithStack(err)
+
+		case <-fire:
+			fire = nil
+			if in.Mode == ModeLeading {
+				// End of the window, changes were delivered on the leading edge
+				continue
+			}
+			if busy {
+				ready = true
+			} else {
+				flush()
+			}
+
+		case <-maxFire:
+			maxFire = nil
+			log.Debug().Int("maxWait", in.MaxWait).Msg("Max wait reached")
+			if busy {
+				due = true
+				ready = true
+			} else {
+				flush()
+			}
+
+		case <-delivered:
+			busy = false
+			if ready {
+				flush()
+			}
+
+		case <-w.rescans:
+			// Events were lost, watch dirs created in the meantime
+			log.Warn().Msg("Event queue overflow, rescanning")
+			w.update(fsnotify.Event{Op: OpRescan})
+			for _, root := range w.tree.Roots() {
+				add(fsnotify.Event{Name: root, Op: OpRescan}, root)
+			}
+
+		case event := <-w.events:
+			root, included, err := w.include(&event, mask)
+			if err != nil {
+				return err
+			}
+			if included {
+				add(event, root)
+			}
+
+		case event := <-w.shared:
+			if !w.tree.Watched(event.Name) {
+				// The dir is watched for another task
+				continue
+			}
+			root, included, err := w.include(&event, mask)
+			if err != nil {
+				return err
+			}
+			if included {
+				add(event, root)
+			}
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+// newTestWatcher watches a temp dir,
+// events can be sent on w.events to simulate changes
+func newTestWatcher(t testing.TB, delay int) (w *Watcher, dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	in := NewCmdIn()
+	in.WatchDirs = MultiFlag{dir}
+	in.Delay = delay
+	w, err := New(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, dir
+}
+
+// waitGoroutines waits for the number of goroutines to drop to n
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("goroutines %v > %v\n%s", runtime.NumGoroutine(), n, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunDebounceStorm(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	w, dir := newTestWatcher(t, 50)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go (func() {
+		done <- w.Run(ctx)
+	})()
+
+	// Many events for fewer paths
+	paths := 100
+	maxGoroutines := 0
+	for i := 0; i < 10000; i++ {
+		w.events <- fsnotify.Event{
+			Name: filepath.Join(dir, fmt.Sprintf("%v.txt", i%paths)),
+			Op:   fsnotify.Write,
+		}
+		if n := runtime.NumGoroutine(); n > maxGoroutines {
+			maxGoroutines = n
+		}
+	}
+	// Goroutines must not grow with the number of events
+	if maxGoroutines > before+10 {
+		t.Fatalf("max goroutines %v, before %v", maxGoroutines, before)
+	}
+
+	select {
+	case changes := <-w.Changes:
+		if len(changes) != paths {
+			t.Fatalf("changes %v, expected %v", len(changes), paths)
+		}
+		last := filepath.Join(dir, fmt.Sprintf("%v.txt", (10000-1)%paths))
+		if changes[len(changes)-1].Path != last {
+			t.Fatalf("last change %v, expected %v",
+				changes[len(changes)-1].Path, last)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected changes")
+	}
+
+	cancel()
+	err := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitGoroutines(t, before)
+}
+
+func TestRunDebounceReset(t *testing.T) {
+	w, dir := newTestWatcher(t, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (func() {
+		_ = w.Run(ctx)
+	})()
+
+	// Events within the delay reset the timer
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		w.events <- fsnotify.Event{
+			Name: filepath.Join(dir, fmt.Sprintf("%v.txt", i)),
+			Op:   fsnotify.Create,
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case changes := <-w.Changes:
+		if len(changes) != 3 {
+			t.Fatalf("changes %v, expected 3", len(changes))
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Fatalf("delivered after %v, expected timer reset", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected changes")
+	}
+}
+
+func TestRunIgnoreOpTimer(t *testing.T) {
+	w, dir := newTestWatcher(t, 100)
+	w.in.IgnoreOps = MultiFlag{"chmod"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (func() {
+		_ = w.Run(ctx)
+	})()
+
+	// Filtered ops keep arriving within the delay,
+	// and must not reset the timer
+	start := time.Now()
+	name := filepath.Join(dir, "a.txt")
+	w.events <- fsnotify.Event{Name: name, Op: fsnotify.Write}
+	go (func() {
+		for i := 0; i < 10; i++ {
+			select {
+			case w.events <- fsnotify.Event{Name: name, Op: fsnotify.Chmod}:
+			case <-ctx.Done():
+				return
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+	})()
+
+	select {
+	case changes := <-w.Changes:
+		elapsed := time.Since(start)
+		if elapsed < 100*time.Millisecond || elapsed > 180*time.Millisecond {
+			t.Fatalf("delivered after %v, expected the original deadline",
+				elapsed)
+		}
+		if len(changes) != 1 || changes[0].Op != fsnotify.Write {
+			t.Fatalf("unexpected changes %v", changes)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected changes")
+	}
+}
+
+// sendEvents sends an event for a new path at each interval,
+// until the stop chan is closed. The returned chan is closed
+// once no more events are sent
+func sendEvents(w *Watcher, dir string, interval time.Duration,
+	stop chan bool) chan bool {
+
+	done := make(chan bool)
+	go (func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			// Check stop first, select picks a ready case at random
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			select {
+			case <-stop:
+				return
+			case w.events <- fsnotify.Event{
+				Name: filepath.Join(dir, fmt.Sprintf("%v.txt", i)),
+				Op:   fsnotify.Create,
+			}:
+			}
+			time.Sleep(interval)
+		}
+	})()
+	return done
+}
+
+func TestRunMaxWait(t *testing.T) {
+	w, dir := newTestWatcher(t, 100)
+	w.in.MaxWait = 250
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (func() {
+		_ = w.Run(ctx)
+	})()
+
+	// Events keep arriving within the delay
+	start := time.Now()
+	stop := make(chan bool)
+	defer close(stop)
+	sendEvents(w, dir, 20*time.Millisecond, stop)
+
+	select {
+	case changes := <-w.Changes:
+		elapsed := time.Since(start)
+		if elapsed < 250*time.Millisecond || elapsed > 500*time.Millisecond {
+			t.Fatalf("delivered after %v, expected max wait", elapsed)
+		}
+		if len(changes) == 0 {
+			t.Fatal("expected changes")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected changes before max wait")
+	}
+}
+
+func TestRunModeLeading(t *testing.T) {
+	w, dir := newTestWatcher(t, 200)
+	w.in.Mode = ModeLeading
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (func() {
+		_ = w.Run(ctx)
+	})()
+
+	// First change is delivered immediately
+	start := time.Now()
+	stop := make(chan bool)
+	sent := sendEvents(w, dir, 20*time.Millisecond, stop)
+	select {
+	case changes := <-w.Changes:
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Fatalf("delivered after %v, expected leading edge", elapsed)
+		}
+		if len(changes) != 1 {
+			t.Fatalf("changes %v, expected 1", len(changes))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected changes")
+	}
+
+	// Changes in the window are ignored
+	select {
+	case changes := <-w.Changes:
+		t.Fatalf("unexpected changes %v in window", changes)
+	case <-time.After(150 * time.Millisecond):
+	}
+	close(stop)
+	<-sent
+
+	// Next change after the window is delivered immediately
+	time.Sleep(100 * time.Millisecond)
+	start = time.Now()
+	w.events <- fsnotify.Event{
+		Name: filepath.Join(dir, "next.txt"), Op: fsnotify.Write}
+	select {
+	case changes := <-w.Changes:
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Fatalf("delivered after %v, expected leading edge", elapsed)
+		}
+		if changes[0].Path != filepath.Join(dir, "next.txt") {
+			t.Fatalf("unexpected change %v", changes[0].Path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected changes")
+	}
+}
+
+func TestRunModeThrottle(t *testing.T) {
+	w, dir := newTestWatcher(t, 100)
+	w.in.Mode = ModeThrottle
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (func() {
+		_ = w.Run(ctx)
+	})()
+
+	// Changes keep arriving, and are delivered once per delay
+	start := time.Now()
+	stop := make(chan bool)
+	defer close(stop)
+	sendEvents(w, dir, 10*time.Millisecond, stop)
+	for i := 1; i <= 3; i++ {
+		select {
+		case changes := <-w.Changes:
+			elapsed := time.Since(start)
+			expected := time.Duration(i) * 100 * time.Millisecond
+			if elapsed < expected-20*time.Millisecond ||
+				elapsed > expected+80*time.Millisecond {
+				t.Fatalf("batch %v delivered after %v, expected %v",
+					i, elapsed, expected)
+			}
+			if len(changes) < 2 {
+				t.Fatalf("changes %v, expected batch", len(changes))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected changes")
+		}
+	}
+}
+
+func TestRunOverflowRescan(t *testing.T) {
+	w, dir := newTestWatcher(t, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go (func() {
+		done <- w.Run(ctx)
+	})()
+
+	// Overflow is not fatal, a synthetic change is emitted for the root
+	w.fs.Errors <- fsnotify.ErrEventOverflow
+	select {
+	case changes := <-w.Changes:
+		if len(changes) != 1 || changes[0].Path != dir ||
+			!changes[0].Op.Has(OpRescan) {
+			t.Fatalf("unexpected changes %v", changes)
+		}
+	case err := <-done:
+		t.Fatalf("unexpected return %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expected rescan change")
+	}
+}
+
+func TestRunOnceNoLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	w, dir := newTestWatcher(t, 10)
+	w.in.Once = true
+	w.OnChange = func(changes []Change) error {
+		return nil
+	}
+	done := make(chan error)
+	go (func() {
+		done <- w.Run(context.Background())
+	})()
+	w.events <- fsnotify.Event{
+		Name: filepath.Join(dir, "a.txt"), Op: fsnotify.Create}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return")
+	}
+	waitGoroutines(t, before)
+}
+
+func BenchmarkRunEvents(b *testing.B) {
+	w, dir := newTestWatcher(b, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (func() {
+		_ = w.Run(ctx)
+	})()
+
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = filepath.Join(dir, fmt.Sprintf("%v.txt", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.events <- fsnotify.Event{Name: names[i%len(names)], Op: fsnotify.Write}
+	}
+}
+
+func TestPollRootRemoved(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "root")
+	err := os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "sub", "a.txt"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := NewCmdIn()
+	in.Recursive = true
+	err = in.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan fsnotify.Event, 10)
+	p := NewPoller(in, time.Second, events, make(chan error))
+	err = p.Add(dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing the root is not an error
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sub", "sub/a.txt"} {
+		event := <-events
+		if event.Name != filepath.Join(dir, name) || event.Op != fsnotify.Remove {
+			t.Fatalf("unexpected event %v, expected remove %v", event, name)
+		}
+	}
+
+	// Created again
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "b.txt"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := <-events
+	if event.Name != filepath.Join(dir, "b.txt") || event.Op != fsnotify.Create {
+		t.Fatalf("unexpected event %v, expected create b.txt", event)
+	}
+}
@@ -3,14 +3,11 @@ package watcher
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"path"
-	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
@@ -26,157 +23,373 @@ func (f *MultiFlag) Set(value string) error {
 	return nil
 }
 
-// Timeout executes the callback after the specified duration.
-// Abort execution by sending a message on the cancel chan
-func Timeout(cancel chan bool, duration time.Duration, cb func()) {
-	if cancel == nil {
-		return
-	}
-	select {
-	case <-time.After(duration):
-		cb()
-	case <-cancel:
-		// Abort
-	}
-}
-
 // CmdIn for use with command functions
 type CmdIn struct {
 	// Debug mode
-	Debug bool
+	Debug bool `json:"-"`
 	// BaseDir for relative paths
-	BaseDir string
+	BaseDir string `json:"baseDir"`
 	// PrintVersion
-	PrintVersion bool
+	PrintVersion bool `json:"-"`
 	// WatchDirs is the dirs to watch
-	WatchDirs MultiFlag
+	WatchDirs MultiFlag `json:"dirs"`
 	// Recursive can be set to watch sub dirs
-	Recursive bool
+	Recursive bool `json:"recursive"`
 	// Delay in milliseconds before printing changes
-	Delay int
+	Delay int `json:"delay"`
+	// MaxWait in milliseconds since the first change before printing,
+	// even if changes keep arriving. Disabled if zero
+	MaxWait int `json:"maxWait"`
+	// Mode for triggering changes, debounce, leading or throttle
+	Mode string `json:"mode"`
 	// Limit sub dirs to watch
-	Limit int
+	Limit int `json:"limit"`
 	// IncludeFiles matching patterns
-	IncludeFiles MultiFlag
+	IncludeFiles MultiFlag `json:"include"`
 	// ExcludeFiles matching patterns
-	ExcludeFiles MultiFlag
+	ExcludeFiles MultiFlag `json:"exclude"`
 	// ExcludeDirs matching patterns
-	ExcludeDirs MultiFlag
+	ExcludeDirs MultiFlag `json:"excludeDir"`
+	// Command to run on start, and restart on change
+	Command string `json:"cmd"`
+	// Stages to run in order before the command,
+	// a stage that fails skips the rest and the command
+	Stages MultiFlag `json:"stage"`
+	// OnBusy policy for changes while the command is running,
+	// restart, queue, skip or parallel
+	OnBusy string `json:"onBusy"`
+	// Parallel is the max number of commands running at once,
+	// if the policy is parallel
+	Parallel int `json:"parallel"`
+	// StopSignal is sent to the process group of the command to stop it
+	StopSignal string `json:"stopSignal"`
+	// StopTimeout to wait for the command to exit before killing it
+	StopTimeout time.Duration `json:"stopTimeout"`
+	// Batch prints all paths changed during the delay, not just the last one
+	Batch bool `json:"batch"`
+	// Format for printing changes, text or json
+	Format string `json:"format"`
+	// Ops to include, all ops are included by default
+	Ops MultiFlag `json:"op"`
+	// IgnoreOps to exclude
+	IgnoreOps MultiFlag `json:"ignoreOp"`
+	// IncludeGlobs for files matching glob patterns, relative to the root
+	IncludeGlobs MultiFlag `json:"includeGlob"`
+	// ExcludeGlobs for files matching glob patterns, relative to the root
+	ExcludeGlobs MultiFlag `json:"excludeGlob"`
+	// ExcludeDirGlobs for dirs matching glob patterns, relative to the root
+	ExcludeDirGlobs MultiFlag `json:"excludeDirGlob"`
+	// GitIgnore excludes files and dirs ignored by .gitignore files
+	GitIgnore bool `json:"gitignore"`
+	// Poll interval, if set the watched dirs are polled for changes
+	Poll time.Duration `json:"poll"`
+	// PollFallback polls dirs that can't be watched
+	PollFallback bool `json:"pollFallback"`
+	// Once stops watching after the first change
+	Once bool `json:"once"`
+	// Timeout stops watching if nothing changed within the duration
+	Timeout time.Duration `json:"timeout"`
+	// Config file path, defaults to watcher.json in the base dir
+	Config string `json:"-"`
+	// Name of the task, output is prefixed with the name if set
+	Name string `json:"name"`
+	// Tasks to run instead, sharing a single watcher.
+	// Tasks are defined in the config file,
+	// options that are not set for a task are copied from the top level
+	Tasks []*CmdIn `json:"tasks"`
+	// SubCmd is set if the first arg is a sub command, e.g. doctor
+	SubCmd string `json:"-"`
+	// Args after the flags
+	Args []string `json:"-"`
+
+	ignore  *Ignore
+	filters *filters
 }
 
+const ModeDebounce = "debounce"
+const ModeLeading = "leading"
+const ModeThrottle = "throttle"
+
 const CmdVersion = "version"
 const CmdWatch = "watch"
+const CmdDoctor = "doctor"
+const CmdList = "list"
+const CmdExplain = "explain"
+
+// SubCmds may be specified as the first arg, before the flags
+var SubCmds = []string{CmdDoctor, CmdList, CmdExplain}
 
 // CmdOut for use with Cmd function
 type CmdOut struct {
 	// Cmd
 	Cmd string
 	// Watcher
-	Watcher *fsnotify.Watcher
+	Watcher *Watcher
+	// Group is set instead of Watcher if tasks are defined
+	Group *Group
+	// Runner is set if a command must be run on change
+	Runner *Runner
+	// Runners for tasks with a command
+	Runners []*Runner
+	// ExitCode for sub commands that exit immediately
+	ExitCode int
 }
 
-func ParseFlags() *CmdIn {
-	in := CmdIn{}
+// NewCmdIn returns options with default values
+func NewCmdIn() *CmdIn {
+	return &CmdIn{
+		Limit:       100,
+		Delay:       1500,
+		Format:      FormatText,
+		Mode:        ModeDebounce,
+		OnBusy:      OnBusyRestart,
+		Parallel:    4,
+		StopSignal:  "SIGTERM",
+		StopTimeout: DefaultStopTimeout,
+	}
+}
 
-	flag.BoolVar(&in.PrintVersion, "version", false, "Print version")
-	flag.BoolVar(&in.Recursive, "r", false, "Recursively watch sub dirs")
-	flag.IntVar(&in.Limit, "l", 100, "Limit dirs to include recursively")
-	flag.IntVar(&in.Delay, "d", 1500,
+// Flags defines the flags for the options on the flag set,
+// current values are used as defaults
+func (in *CmdIn) Flags(fs *flag.FlagSet) {
+
+	fs.BoolVar(&in.PrintVersion, "version", in.PrintVersion, "Print version")
+	fs.BoolVar(&in.Recursive, "r", in.Recursive, "Recursively watch sub dirs")
+	fs.IntVar(&in.Limit, "l", in.Limit, "Limit dirs to include recursively")
+	fs.IntVar(&in.Delay, "d", in.Delay,
 		"Delay in milliseconds before printing changes")
-	flag.StringVar(&in.BaseDir, "b", "", "Base dir for relative paths")
-	flag.Var(&in.WatchDirs, "dir", "Dirs to watch")
-	flag.Var(&in.IncludeFiles, "include", "Only include matching files")
-	flag.Var(&in.ExcludeFiles, "exclude", "Exclude matching files")
-	flag.Var(&in.ExcludeDirs, "excludeDir", "Exclude matching dirs")
-	flag.Parse()
-
-	return &in
+	fs.StringVar(&in.Mode, "mode", in.Mode,
+		"Trigger mode: debounce waits for the delay after the last change, "+
+			"leading triggers on the first change and ignores changes "+
+			"for the delay, throttle triggers at most once per delay")
+	fs.IntVar(&in.MaxWait, "maxWait", in.MaxWait,
+		"Max delay in milliseconds since the first change before printing, "+
+			"even if changes keep arriving")
+	fs.StringVar(&in.BaseDir, "b", in.BaseDir, "Base dir for relative paths")
+	fs.Var(&in.WatchDirs, "dir", "Dirs to watch")
+	fs.Var(&in.IncludeFiles, "include", "Only include matching files")
+	fs.Var(&in.ExcludeFiles, "exclude", "Exclude matching files")
+	fs.Var(&in.ExcludeDirs, "excludeDir", "Exclude matching dirs")
+	fs.StringVar(&in.Command, "cmd", in.Command,
+		"Command to run on start, and restart on change")
+	fs.Var(&in.Stages, "stage",
+		"Stage to run before the command, repeat for a pipeline. "+
+			"The pipeline stops at the first stage that fails")
+	fs.StringVar(&in.OnBusy, "onBusy", in.OnBusy,
+		"Policy for changes while the command is running: restart stops "+
+			"the command and starts it again, queue runs it once more after "+
+			"it exits, skip drops the changes, "+
+			"parallel runs up to -parallel commands at once")
+	fs.IntVar(&in.Parallel, "parallel", in.Parallel,
+		"Max commands running at once with -onBusy parallel")
+	fs.StringVar(&in.StopSignal, "stopSignal", in.StopSignal,
+		"Signal sent to the process group of the command to stop it, "+
+			"e.g. SIGINT")
+	fs.DurationVar(&in.StopTimeout, "stopTimeout", in.StopTimeout,
+		"Wait for the command to exit after the stop signal, "+
+			"before sending SIGKILL")
+	fs.BoolVar(&in.Batch, "batch", in.Batch,
+		"Print all paths changed during the delay, one per line")
+	fs.StringVar(&in.Format, "format", in.Format,
+		"Output format, text or json (JSON Lines)")
+	fs.Var(&in.Ops, "op",
+		"Only include ops, e.g. write,create,remove,rename,chmod")
+	fs.Var(&in.IgnoreOps, "ignoreOp", "Exclude ops, e.g. chmod")
+	fs.Var(&in.IncludeGlobs, "includeGlob",
+		"Only include files matching glob, e.g. **/*.go")
+	fs.Var(&in.ExcludeGlobs, "excludeGlob", "Exclude files matching glob")
+	fs.Var(&in.ExcludeDirGlobs, "excludeDirGlob",
+		"Exclude dirs matching glob, e.g. **/node_modules")
+	fs.BoolVar(&in.GitIgnore, "gitignore", in.GitIgnore,
+		"Exclude files and dirs ignored by .gitignore, .ignore "+
+			"and .git/info/exclude")
+	fs.DurationVar(&in.Poll, "poll", in.Poll,
+		"Poll for changes at this interval instead of watching, e.g. 500ms")
+	fs.BoolVar(&in.PollFallback, "pollFallback", in.PollFallback,
+		"Poll dirs that can't be watched, "+
+			"at the poll interval or "+DefaultPollInterval.String())
+	fs.BoolVar(&in.Once, "once", in.Once, "Exit after the first change")
+	fs.DurationVar(&in.Timeout, "timeout", in.Timeout,
+		"Exit with code 3 if nothing changed within the duration, e.g. 1m")
+	fs.StringVar(&in.Config, "config", in.Config,
+		"Config file, defaults to "+ConfigFile+" in the base dir")
+}
+
+// ParseFlags parses the command line flags with the global flag set,
+// the first arg may be a sub command
+func ParseFlags() *CmdIn {
+	in := NewCmdIn()
+	in.Flags(flag.CommandLine)
+	args := os.Args[1:]
+	if len(args) > 0 {
+		for _, subCmd := range SubCmds {
+			if args[0] == subCmd {
+				in.SubCmd = subCmd
+				args = args[1:]
+				break
+			}
+		}
+	}
+	// The global flag set exits on error
+	_ = flag.CommandLine.Parse(args)
+	in.Args = flag.Args()
+	return in
+}
+
+// FileIncluded checks the path against the file filters.
+// Globs are matched against the path relative to the watched root
+func (in *CmdIn) FileIncluded(root, p string) (included bool, err error) {
+	included, rule, err := in.FileRule(root, p)
+	if err != nil {
+		return false, err
+	}
+	if !included {
+		log.Debug().Str("name", p).Str("rule", rule).Msg("Excluded")
+	}
+	return included, nil
 }
 
-func (in *CmdIn) FileIncluded(p string) (included bool, err error) {
-	// TODO Compile patterns once and cache?
+// FileRule checks the path against the file filters,
+// and returns the rule that included or excluded it
+func (in *CmdIn) FileRule(root, p string) (
+	included bool, rule string, err error) {
+
+	f, err := in.getFilters()
+	if err != nil {
+		return false, rule, err
+	}
+	rel := RelPath(root, p)
 	// Excluded?
-	for _, excludeFile := range in.ExcludeFiles {
-		match, err := regexp.MatchString(excludeFile, p)
+	for _, excludeFile := range f.excludeFiles {
+		if excludeFile.re.MatchString(p) {
+			return false, excludeFile.String(), nil
+		}
+	}
+	for _, excludeGlob := range f.excludeGlobs {
+		if excludeGlob.re.MatchString(rel) {
+			return false, excludeGlob.String(), nil
+		}
+	}
+	if in.ignore != nil {
+		info, err := os.Lstat(p)
+		isDir := err == nil && info.IsDir()
+		ignored, err := in.ignore.IgnoredBy(root, p, isDir)
 		if err != nil {
-			return false, errors.WithStack(err)
+			return false, rule, errors.WithStack(err)
 		}
-		if match {
-			log.Debug().Str("name", p).Msg("Excluded")
-			return false, nil
+		if ignored != "" {
+			return false, "-gitignore " + ignored, nil
 		}
 	}
 	// Included?
-	if len(in.IncludeFiles) == 0 {
+	if len(f.includeFiles) == 0 && len(f.includeGlobs) == 0 {
 		// All files are included by default
-		return true, nil
+		return true, "no include filters", nil
 	}
-	for _, includeFile := range in.IncludeFiles {
-		match, err := regexp.MatchString(includeFile, p)
-		if err != nil {
-			return false, errors.WithStack(err)
+	for _, includeFile := range f.includeFiles {
+		if includeFile.re.MatchString(p) {
+			return true, includeFile.String(), nil
 		}
-		if match {
-			return true, nil
+	}
+	for _, includeGlob := range f.includeGlobs {
+		if includeGlob.re.MatchString(rel) {
+			return true, includeGlob.String(), nil
 		}
 	}
+	return false, "no include filters matched", nil
+}
+
+// DirExcluded checks the path against the dir filters.
+// Globs are matched against the path relative to the watched root
+func (in *CmdIn) DirExcluded(root, p string) (excluded bool, err error) {
+	rule, err := in.DirRule(root, p)
+	if err != nil {
+		return false, err
+	}
+	if rule != "" {
+		log.Debug().Str("path", p).Str("rule", rule).Msg("Excluded dir")
+		return true, nil
+	}
 	return false, nil
 }
 
-func (in *CmdIn) DirExcluded(p string) (excluded bool, err error) {
-	if len(in.ExcludeDirs) == 0 {
+// DirRule checks the path against the dir filters,
+// and returns the rule that excluded it, or an empty string
+func (in *CmdIn) DirRule(root, p string) (rule string, err error) {
+	if in.ignore != nil {
+		ignored, err := in.ignore.IgnoredBy(root, p, true)
+		if err != nil {
+			return rule, errors.WithStack(err)
+		}
+		if ignored != "" {
+			return "-gitignore " + ignored, nil
+		}
+	}
+	f, err := in.getFilters()
+	if err != nil {
+		return rule, err
+	}
+	if len(f.excludeDirs) == 0 && len(f.excludeDirGlobs) == 0 {
 		// No dirs are excluded by default
-		return false, nil
+		return "", nil
 	}
-	// TODO Compile patterns once and cache
-	for _, excludeDir := range in.ExcludeDirs {
-		match, err := regexp.MatchString(excludeDir, p)
-		if err != nil {
-			return excluded, errors.WithStack(err)
+	for _, excludeDir := range f.excludeDirs {
+		if excludeDir.re.MatchString(p) {
+			return excludeDir.String(), nil
 		}
-		if match {
-			return true, nil
+	}
+	rel := RelPath(root, p)
+	for _, excludeDirGlob := range f.excludeDirGlobs {
+		if excludeDirGlob.re.MatchString(rel) {
+			return excludeDirGlob.String(), nil
 		}
 	}
-	return false, nil
+	return "", nil
 }
 
-func (in *CmdIn) Watch(watcher *fsnotify.Watcher) {
-	var cancel chan bool
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-
-			// Check if file must be included
-			included, err := in.FileIncluded(event.Name)
-			if err != nil {
-				watcher.Errors <- err
-				return
-			}
-
-			if included {
-				log.Debug().
-					Str("op", event.Op.String()).
-					Str("name", event.Name).
-					Msg("Included")
-				// Cancel previous timeout if set
-				if cancel != nil {
-					close(cancel)
-				}
-				// Reset cancel chan
-				cancel = make(chan bool)
-				// Use a timeout in case multiple files were changed
-				go Timeout(cancel, time.Duration(in.Delay)*time.Millisecond,
-					func() {
-						// Print path to last file that was modified
-						fmt.Printf("%v\n", event.Name)
-					})
-			}
-		}
+// Prepare validates the options, and sets up the filters
+func (in *CmdIn) Prepare() (err error) {
+	if in.Format != FormatText && in.Format != FormatJSON {
+		return errors.WithStack(
+			fmt.Errorf("invalid format %v", in.Format))
+	}
+	switch in.Mode {
+	case "":
+		in.Mode = ModeDebounce
+	case ModeDebounce, ModeLeading, ModeThrottle:
+	default:
+		return errors.WithStack(fmt.Errorf("invalid mode %v", in.Mode))
+	}
+	switch in.OnBusy {
+	case "":
+		in.OnBusy = OnBusyRestart
+	case OnBusyRestart, OnBusyQueue, OnBusySkip, OnBusyParallel:
+	default:
+		return errors.WithStack(fmt.Errorf("invalid onBusy %v", in.OnBusy))
+	}
+	if in.OnBusy == OnBusyParallel && in.Parallel < 1 {
+		return errors.WithStack(fmt.Errorf("invalid parallel %v", in.Parallel))
+	}
+	if in.StopSignal == "" {
+		in.StopSignal = "SIGTERM"
+	}
+	_, err = ParseSignal(in.StopSignal)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = in.OpMask()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Invalid patterns must fail before watching
+	in.filters, err = in.compileFilters()
+	if err != nil {
+		return err
+	}
+	if in.GitIgnore {
+		in.ignore = NewIgnore()
 	}
+	return nil
 }
 
 func Cmd(in *CmdIn) (out *CmdOut, err error) {
@@ -186,91 +399,191 @@ func Cmd(in *CmdIn) (out *CmdOut, err error) {
 		out.Cmd = CmdVersion
 		return out, nil
 	}
+
+	if in.SubCmd != "" {
+		out.Cmd = in.SubCmd
+		out.ExitCode, err = in.runSubCmd(os.Stdout)
+		if err != nil {
+			return out, errors.WithStack(err)
+		}
+		return out, nil
+	}
 	out.Cmd = CmdWatch
 
-	out.Watcher, err = fsnotify.NewWatcher()
+	if len(in.Tasks) > 0 {
+		return cmdTasks(in, out)
+	}
+
+	out.Watcher, err = New(in)
 	if err != nil {
 		return out, errors.WithStack(err)
 	}
 
-	go in.Watch(out.Watcher)
-
-	for _, relativePath := range in.WatchDirs {
+	out.Runner, err = in.newRunner()
+	if err != nil {
+		_ = out.Watcher.Close()
+		return out, errors.WithStack(err)
+	}
+	out.Watcher.OnChange = in.onChange(out.Runner)
 
-		// Use absolute paths
-		var absolutePath string
-		if filepath.IsAbs(relativePath) {
-			absolutePath = relativePath
-		} else {
-			// Prefix basedir
-			absolutePath = path.Join(in.BaseDir, relativePath)
+	if out.Runner != nil {
+		err = out.Runner.Start()
+		if err != nil {
+			_ = out.Watcher.Close()
+			return out, errors.WithStack(err)
 		}
+	}
+
+	return out, nil
+}
 
-		// Check dir exclusion filter
-		excluded, err := in.DirExcluded(absolutePath)
+// runSubCmd runs the subcommand for the options, or for each task
+// with a header if tasks are set. Returns the exit code
+func (in *CmdIn) runSubCmd(w io.Writer) (exitCode int, err error) {
+	if in.SubCmd == CmdExplain && len(in.Args) == 0 {
+		return 0, errors.WithStack(
+			fmt.Errorf("usage: watcher explain [flags] <path>..."))
+	}
+
+	targets := in.Tasks
+	if len(targets) == 0 {
+		targets = []*CmdIn{in}
+	}
+	// Paths are included if any task includes them
+	included := make([]bool, len(in.Args))
+	for i, target := range targets {
+		if len(in.Tasks) > 0 {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "[%v]\n", target.Name)
+		}
+		// Prepared like the watchers in a group
+		err = target.prepare()
 		if err != nil {
-			return out, errors.WithStack(err)
+			return 0, errors.Wrapf(err, "task %v", target.Name)
 		}
 
-		if !excluded {
-			// Watch the specified dir
-			log.Debug().Str("path", absolutePath).Msg("Add path")
-			err = out.Watcher.Add(absolutePath)
+		switch in.SubCmd {
+		case CmdDoctor:
+			problems, err := target.Doctor(w)
 			if err != nil {
-				return out, errors.WithStack(err)
+				return 0, errors.WithStack(err)
+			}
+			if problems > 0 {
+				exitCode = 1
 			}
 
-			// Watch sub dirs recursively
-			r := 0
-			if in.Recursive {
-				err = filepath.Walk(absolutePath,
-					func(p string, info os.FileInfo, err error) error {
-						// Don't include path twice and check limit
-						if p != absolutePath && r < in.Limit {
-							if info.IsDir() {
-								if strings.HasPrefix(info.Name(), ".") {
-									// Skip hidden dirs
-									return filepath.SkipDir
-								} else {
-									// Check dir exclusion filter
-									excluded, err := in.DirExcluded(p)
-									if err != nil {
-										return errors.WithStack(err)
-									}
-									if excluded {
-										// Skip excluded dirs
-										return filepath.SkipDir
-									} else {
-										// Watch sub dir
-										log.Debug().Str("path", p).
-											Msg("Add sub path")
-										err = out.Watcher.Add(p)
-										if err != nil {
-											return errors.WithStack(err)
-										}
-										r++
-									}
-								}
-							}
-						}
-						return nil
-					})
+		case CmdList:
+			err = target.List(w)
+			if err != nil {
+				return 0, errors.WithStack(err)
+			}
+
+		case CmdExplain:
+			for j, p := range in.Args {
+				if j > 0 {
+					fmt.Fprintln(w)
+				}
+				ok, err := target.Explain(w, p)
 				if err != nil {
-					return out, errors.WithStack(err)
+					return 0, errors.WithStack(err)
 				}
+				included[j] = included[j] || ok
 			}
+
+		default:
+			return 0, errors.WithStack(
+				fmt.Errorf("invalid subcommand %v", in.SubCmd))
+		}
+	}
+
+	for _, ok := range included {
+		if !ok {
+			exitCode = 1
+		}
+	}
+	return exitCode, nil
+}
+
+// cmdTasks creates a group to watch for the tasks,
+// and starts the command for each task
+func cmdTasks(in *CmdIn, out *CmdOut) (*CmdOut, error) {
+	var err error
+	out.Group, err = NewGroup(in.Tasks)
+	if err != nil {
+		return out, errors.WithStack(err)
+	}
+
+	for i, task := range in.Tasks {
+		runner, err := task.newRunner()
+		if err != nil {
+			_ = out.Group.Close()
+			return out, errors.WithStack(err)
+		}
+		if runner != nil {
+			out.Runners = append(out.Runners, runner)
+		}
+		out.Group.Watchers[i].OnChange = task.onChange(runner)
+	}
+
+	for i, runner := range out.Runners {
+		err = runner.Start()
+		if err != nil {
+			for _, started := range out.Runners[:i] {
+				_ = started.Stop()
+			}
+			_ = out.Group.Close()
+			return out, errors.WithStack(err)
 		}
 	}
 
 	return out, nil
 }
 
+// newRunner returns a runner for the command and stages,
+// or nil if not set
+func (in *CmdIn) newRunner() (runner *Runner, err error) {
+	if in.Command == "" && len(in.Stages) == 0 {
+		return nil, nil
+	}
+	runner = NewRunner(in.Command)
+	runner.Stages = in.Stages
+	runner.Name = in.Name
+	runner.BaseDir = in.BaseDir
+	runner.OnBusy = in.OnBusy
+	runner.Parallel = in.Parallel
+	runner.StopSignal, err = ParseSignal(in.StopSignal)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	runner.StopTimeout = in.StopTimeout
+	return runner, nil
+}
+
+// onChange runs the command for the changes if the runner is set,
+// otherwise the changes are printed
+func (in *CmdIn) onChange(runner *Runner) func(changes []Change) error {
+	return func(changes []Change) error {
+		if runner != nil {
+			return runner.Change(changes)
+		}
+		return in.Print(changes)
+	}
+}
+
 func Main(debug bool) (out *CmdOut, err error) {
 	// Parse flags
 	in := ParseFlags()
 
 	in.Debug = debug
 
+	// Flags override values from the config file
+	err = in.LoadConfig(flag.CommandLine)
+	if err != nil {
+		return out, errors.WithStack(err)
+	}
+
 	// Resolve base dir in this order (flag, env, working dir).
 	// Specifying absolute paths for dirs/files to watch is also supported,
 	// in that case the dir/file path is not prefixed with the base dir
@@ -293,6 +606,12 @@ func Main(debug bool) (out *CmdOut, err error) {
 		}
 	}
 
+	for _, task := range in.Tasks {
+		if task.BaseDir == "" {
+			task.BaseDir = in.BaseDir
+		}
+	}
+
 	// Run cmd
 	out, err = Cmd(in)
 	if err != nil {